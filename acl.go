@@ -1,6 +1,12 @@
 package wsqueue
 
-import "net/http"
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
 
 //ACL  stands for Access Control List. It's a slice of permission for a queue or a topic
 type ACL []ACE
@@ -21,7 +27,8 @@ func (a *ACEDigest) Scheme() ACLScheme {
 	return ACLSSchemeDigest
 }
 
-//ACEIP aims to authenticate a user with a IP adress
+//ACEIP aims to authenticate a user with a IP adress. The IP is read from X-Forwarded-For,
+//or resolved through the proxies of Server.TrustedProxies if they are set
 type ACEIP struct {
 	IP string `json:"ip,omitempty"`
 }
@@ -39,7 +46,46 @@ func (a *ACEWorld) Scheme() ACLScheme {
 	return ACLSSchemeWorld
 }
 
-//ACLScheme : There are three different scheme
+//Identity is the principal authenticated on a connection
+type Identity struct {
+	Username string                 `json:"username,omitempty"`
+	Claims   map[string]interface{} `json:"claims,omitempty"`
+	IP       string                 `json:"ip,omitempty"`
+}
+
+//key identifies the client for quotas: the username if authenticated, the IP otherwise
+func (i *Identity) key() string {
+	if i.Username != "" {
+		return "user:" + i.Username
+	}
+	return "ip:" + i.IP
+}
+
+//Authenticator aims to authenticate a user with custom logic. It returns the
+//identity of the user or an error if the request is not authenticated
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+//AuthenticatorFunc is an adapter to use an ordinary function as Authenticator
+type AuthenticatorFunc func(r *http.Request) (*Identity, error)
+
+//Authenticate calls f(r)
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (*Identity, error) {
+	return f(r)
+}
+
+//ACECustom aims to authenticate a user with an Authenticator
+type ACECustom struct {
+	Authenticator Authenticator `json:"-"`
+}
+
+//Scheme is Custom
+func (a *ACECustom) Scheme() ACLScheme {
+	return ACLSSchemeCustom
+}
+
+//ACLScheme : There are four different scheme
 type ACLScheme string
 
 const (
@@ -49,24 +95,109 @@ const (
 	ACLSSchemeDigest = "DIGEST"
 	//ACLSSchemeIP scheme represents a "manually" set group of  user authenticated by their IP address
 	ACLSSchemeIP = "IP"
+	//ACLSSchemeCustom scheme represents users authenticated by an Authenticator
+	ACLSSchemeCustom = "CUSTOM"
 )
 
-func checkACL(acl ACL, w http.ResponseWriter, r *http.Request) bool {
+//remoteIP returns the IP of the client. See forwardedIP for clients behind a proxy
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+//forwardedIP returns the IP of the client from X-Forwarded-For if the request comes from
+//a trusted proxy. The header is read from the right, skipping the trusted proxies, so a
+//client cannot choose its IP by setting the header itself
+func forwardedIP(r *http.Request, trusted []string) string {
+	if !isTrustedProxy(remoteIP(r), trusted) {
+		return ""
+	}
+	var ip string
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip = strings.TrimSpace(forwarded[i])
+		if !isTrustedProxy(ip, trusted) {
+			break
+		}
+	}
+	return ip
+}
+
+//trustedProxies returns the trusted proxies of the server, if any
+func (s *Server) trustedProxies() []string {
+	if s == nil {
+		return nil
+	}
+	return s.TrustedProxies
+}
+
+//isTrustedProxy checks ip against a list of IPs and CIDRs
+func isTrustedProxy(ip string, trusted []string) bool {
+	parsed := net.ParseIP(ip)
+	for _, proxy := range trusted {
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			if parsed != nil && network.Contains(parsed) {
+				return true
+			}
+		} else if proxy == ip || (parsed != nil && parsed.Equal(net.ParseIP(proxy))) {
+			return true
+		}
+	}
+	return false
+}
+
+//ErrForbidden can be returned by an Authenticator to reject an authenticated user
+//with a 403 Forbidden instead of a 401 Unauthorized
+var ErrForbidden = errors.New("Forbidden")
+
+var errUnauthorized = errors.New("Unauthorized")
+
+//checkACL replies with a JSON error if the request is not authorized: 401 with a
+//Basic challenge for DIGEST, 401 for CUSTOM and 403 otherwise
+func checkACL(acl ACL, destination string, w http.ResponseWriter, r *http.Request, trusted []string) (*Identity, bool) {
+	id, err := authorize(acl, r, trusted)
+	if err == nil {
+		return id, true
+	}
+	if err == ErrForbidden {
+		writeError(w, http.StatusForbidden, "Not Authorized by ACL", destination)
+		return nil, false
+	}
+	for _, ace := range acl {
+		if ace.Scheme() == ACLSSchemeDigest {
+			w.Header().Set("WWW-Authenticate", `Basic realm="wsqueue", charset="UTF-8"`)
+			break
+		}
+	}
+	writeError(w, http.StatusUnauthorized, "Not Authenticated", destination)
+	return nil, false
+}
+
+//authorize returns errUnauthorized if the request may be authorized with other
+//credentials, or ErrForbidden. If trusted proxies are set, the IP of the client has
+//already been resolved in r.RemoteAddr, see forwardedIP
+func authorize(acl ACL, r *http.Request, trusted []string) (*Identity, error) {
+	var err = ErrForbidden
 	for _, ace := range acl {
 		switch ace.Scheme() {
 		case ACLSSchemeWorld:
 			Logfunc("Connection Authorized")
-			return true
+			return &Identity{IP: remoteIP(r)}, nil
 		case ACLSSchemeIP:
 			ip := r.Header.Get("X-Forwarded-For")
+			if len(trusted) > 0 {
+				ip = remoteIP(r)
+			}
 			aceIP, b := ace.(*ACEIP)
 			if !b {
-				w.WriteHeader(http.StatusUnauthorized)
-				return false
+				continue
 			}
 			if ip == aceIP.IP {
 				Logfunc("Connection Authorized for IP %s", ip)
-				return true
+				return &Identity{IP: ip}, nil
 			}
 			Warnfunc("Connection unauthorized for IP:%s", ip)
 		case ACLSSchemeDigest:
@@ -75,12 +206,59 @@ func checkACL(acl ACL, w http.ResponseWriter, r *http.Request) bool {
 				aceDigest, b := ace.(*ACEDigest)
 				if b && aceDigest.Username == u && aceDigest.Password == p {
 					Logfunc("Connection Authorized with BasicAuth %s", u)
-					return true
+					return &Identity{Username: u, IP: remoteIP(r)}, nil
 				}
 			}
 			Warnfunc("Connection unauthorized for BasicAuth %s", u)
+			err = errUnauthorized
+		case ACLSSchemeCustom:
+			aceCustom, b := ace.(*ACECustom)
+			if !b || aceCustom.Authenticator == nil {
+				continue
+			}
+			id, e := aceCustom.Authenticator.Authenticate(r)
+			if e != nil {
+				Warnfunc("Connection unauthorized by Authenticator : %s", e.Error())
+				if e != ErrForbidden {
+					err = errUnauthorized
+				}
+				continue
+			}
+			if id == nil {
+				id = &Identity{}
+			}
+			if id.IP == "" {
+				id.IP = remoteIP(r)
+			}
+			Logfunc("Connection Authorized by Authenticator %s", id.Username)
+			return id, nil
+		}
+	}
+	return nil, err
+}
+
+//setACL swaps the ACL of options and closes the connections rejected by the new ACL if asked
+func setACL(mutex *sync.RWMutex, options **Options, wsConnections map[ConnID]*Conn, acl ACL, disconnect bool, trusted []string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	o := Options{}
+	if *options != nil {
+		o = **options
+	}
+	o.ACL = acl
+	*options = &o
+
+	if !disconnect || len(acl) == 0 {
+		return
+	}
+	for id, conn := range wsConnections {
+		if conn.request == nil {
+			continue
+		}
+		if _, err := authorize(acl, conn.request, trusted); err != nil {
+			Warnfunc("Connection %s not authorized anymore by ACL. Closing", id)
+			conn.WSConn.Close()
 		}
 	}
-	w.WriteHeader(http.StatusUnauthorized)
-	return false
 }
@@ -1,10 +1,19 @@
 package wsqueue
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 	"github.com/phayes/freeport"
 	"github.com/stretchr/testify/assert"
 )
@@ -20,13 +29,16 @@ func TestCheckACLShouldAuthorizeEveryoneWhenACEIsSetToWord(t *testing.T) {
 
 	//setup server
 	handler := func(w http.ResponseWriter, r *http.Request) {
-		assert.True(t, checkACL(acl, w, r), "check should return true")
+		_, ok := checkACL(acl, "", w, r, nil)
+		assert.True(t, ok, "check should return true")
 		wait <- true
 	}
 	http.HandleFunc(fmt.Sprintf("/%d", port), handler)
 	//Run the server
 	t.Logf("Starting test server on port %d", port)
-	go http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	assert.NoError(t, err)
+	go http.Serve(l, nil)
 
 	//Run the test
 	t.Logf("Calling the test server")
@@ -49,18 +61,21 @@ func TestCheckACLShouldAuthorizeLocalIPWhenACEIsSetLocalIP(t *testing.T) {
 
 	//setup server
 	handler := func(w http.ResponseWriter, r *http.Request) {
-		assert.True(t, checkACL(acl, w, r), "check should return true")
+		_, ok := checkACL(acl, "", w, r, nil)
+		assert.True(t, ok, "check should return true")
 		wait <- true
 	}
 	http.HandleFunc(fmt.Sprintf("/%d", port), handler)
 	//Run the server
 	t.Logf("Starting test server on port %d", port)
-	go http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	assert.NoError(t, err)
+	go http.Serve(l, nil)
 
 	//Run the test
 	t.Logf("Calling the test server")
 	client := http.DefaultClient
-	req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d/%d", port, port), nil)
+	req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d/%d", port, port), nil)
 	req.Header.Set("X-Forwarded-For", "localhost0")
 	res, err := client.Do(req)
 	assert.NoError(t, err)
@@ -80,13 +95,16 @@ func TestCheckACLShouldUnauthorizeLocalIPWhenACEIPIsSetToFooBar(t *testing.T) {
 
 	//setup server
 	handler := func(w http.ResponseWriter, r *http.Request) {
-		assert.False(t, checkACL(acl, w, r), "check should return false")
+		_, ok := checkACL(acl, "", w, r, nil)
+		assert.False(t, ok, "check should return false")
 		wait <- true
 	}
 	http.HandleFunc(fmt.Sprintf("/%d", port), handler)
 	//Run the server
 	t.Logf("Starting test server on port %d", port)
-	go http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	assert.NoError(t, err)
+	go http.Serve(l, nil)
 
 	//Run the test
 	t.Logf("Calling the test server")
@@ -95,7 +113,7 @@ func TestCheckACLShouldUnauthorizeLocalIPWhenACEIPIsSetToFooBar(t *testing.T) {
 	req.Header.Set("X-Forwarded-For", "localhost")
 	res, err := client.Do(req)
 	assert.NoError(t, err)
-	assert.Equal(t, http.StatusUnauthorized, res.StatusCode, "status code should be "+string(http.StatusUnauthorized))
+	assert.Equal(t, http.StatusForbidden, res.StatusCode, "status code should be 403")
 	wait <- true
 
 	<-wait
@@ -113,18 +131,21 @@ func TestCheckACLShouldAuthorizeFooBarWhenACEDigetIsSetToFooBar(t *testing.T) {
 
 	//setup server
 	handler := func(w http.ResponseWriter, r *http.Request) {
-		assert.True(t, checkACL(acl, w, r), "check should return true")
+		_, ok := checkACL(acl, "", w, r, nil)
+		assert.True(t, ok, "check should return true")
 		wait <- true
 	}
 	http.HandleFunc(fmt.Sprintf("/%d", port), handler)
 	//Run the server
 	t.Logf("Starting test server on port %d", port)
-	go http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	assert.NoError(t, err)
+	go http.Serve(l, nil)
 
 	//Run the test
 	t.Logf("Calling the test server")
 	client := http.DefaultClient
-	req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d/%d", port, port), nil)
+	req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d/%d", port, port), nil)
 	req.SetBasicAuth("Foo", "Bar")
 	res, err := client.Do(req)
 	assert.NoError(t, err)
@@ -144,13 +165,16 @@ func TestCheckACLShouldUnauthorizeFooBarWhenACEDigetIsSetToXXXXX(t *testing.T) {
 
 	//setup server
 	handler := func(w http.ResponseWriter, r *http.Request) {
-		assert.False(t, checkACL(acl, w, r), "check should return false")
+		_, ok := checkACL(acl, "", w, r, nil)
+		assert.False(t, ok, "check should return false")
 		wait <- true
 	}
 	http.HandleFunc(fmt.Sprintf("/%d", port), handler)
 	//Run the server
 	t.Logf("Starting test server on port %d", port)
-	go http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	assert.NoError(t, err)
+	go http.Serve(l, nil)
 
 	//Run the test
 	t.Logf("Calling the test server")
@@ -159,9 +183,148 @@ func TestCheckACLShouldUnauthorizeFooBarWhenACEDigetIsSetToXXXXX(t *testing.T) {
 	req.SetBasicAuth("Foo", "Bar")
 	res, err := client.Do(req)
 	assert.NoError(t, err)
-	assert.Equal(t, http.StatusUnauthorized, res.StatusCode, "status code should be "+string(http.StatusUnauthorized))
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode, "status code should be 401")
+	assert.Equal(t, `Basic realm="wsqueue", charset="UTF-8"`, res.Header.Get("WWW-Authenticate"))
 	wait <- true
 
 	<-wait
 	<-wait
 }
+
+func TestCheckACLShouldAuthorizeFooWhenAuthenticatorReturnsFoo(t *testing.T) {
+	//setup ACL
+	acl := ACL{
+		&ACECustom{AuthenticatorFunc(func(r *http.Request) (*Identity, error) {
+			if r.Header.Get("X-Token") != "secret" {
+				return nil, errors.New("bad token")
+			}
+			return &Identity{Username: "Foo", Claims: map[string]interface{}{"role": "admin"}}, nil
+		})},
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Token", "secret")
+	req.RemoteAddr = "10.0.0.1:1234"
+	w := httptest.NewRecorder()
+	id, ok := checkACL(acl, "", w, req, nil)
+	assert.True(t, ok, "check should return true")
+	assert.Equal(t, "Foo", id.Username)
+	assert.Equal(t, "admin", id.Claims["role"])
+	assert.Equal(t, "10.0.0.1", id.IP)
+}
+
+func TestCheckACLShouldUnauthorizeWhenAuthenticatorFails(t *testing.T) {
+	//setup ACL
+	acl := ACL{
+		&ACECustom{AuthenticatorFunc(func(r *http.Request) (*Identity, error) {
+			return nil, errors.New("bad token")
+		})},
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	id, ok := checkACL(acl, "", w, req, nil)
+	assert.False(t, ok, "check should return false")
+	assert.Nil(t, id)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Empty(t, w.Header().Get("WWW-Authenticate"))
+}
+
+func TestCheckACLShouldForbidWhenAuthenticatorReturnsErrForbidden(t *testing.T) {
+	//setup ACL
+	acl := ACL{
+		&ACECustom{AuthenticatorFunc(func(r *http.Request) (*Identity, error) {
+			return nil, ErrForbidden
+		})},
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	_, ok := checkACL(acl, "myQueue", w, req, nil)
+	assert.False(t, ok, "check should return false")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	var e ErrorResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&e))
+	assert.Equal(t, ErrorResponse{Code: 403, Reason: "Not Authorized by ACL", Destination: "myQueue"}, e)
+}
+
+func TestSetACLShouldDisconnectUnauthorizedConnections(t *testing.T) {
+	r := mux.NewRouter()
+	s := NewServer(r, "/TestSetACL")
+	topic := s.CreateTopic("topic")
+	topic.SetACL(ACL{&ACEDigest{Username: "Foo", Password: "Bar"}}, false)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	header := http.Header{}
+	header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("Foo:Bar")))
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/TestSetACL/wsqueue/topic/topic"
+	c, _, err := websocket.DefaultDialer.Dial(url, header)
+	assert.NoError(t, err)
+	defer c.Close()
+
+	topic.SetACL(ACL{&ACEDigest{Username: "Foo", Password: "Baz"}}, true)
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = c.ReadMessage()
+	assert.Error(t, err)
+	if e, ok := err.(net.Error); ok {
+		assert.False(t, e.Timeout(), "connection should have been closed")
+	}
+
+	_, _, err = websocket.DefaultDialer.Dial(url, header)
+	assert.Error(t, err, "old credentials should be rejected")
+}
+
+func TestServerShouldReplyNotFoundForUnknownDestination(t *testing.T) {
+	r := mux.NewRouter()
+	s := NewServer(r, "/TestNotFound")
+	s.CreateQueue("queue", 10)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/TestNotFound/wsqueue/topic/queue")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	var e ErrorResponse
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&e))
+	assert.Equal(t, "queue", e.Destination)
+
+	res, err = http.Get(ts.URL + "/TestNotFound/wsqueue/queue/queue")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode, "plain HTTP request should not be upgraded")
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&e))
+	assert.Equal(t, "queue", e.Destination)
+}
+
+func TestForwardedIPShouldOnlyTrustProxies(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4, 5.6.7.8")
+	assert.Equal(t, "", forwardedIP(req, nil))
+	assert.Equal(t, "10.0.0.1", remoteIP(req))
+	assert.Equal(t, "5.6.7.8", forwardedIP(req, []string{"10.0.0.1"}))
+	assert.Equal(t, "1.2.3.4", forwardedIP(req, []string{"10.0.0.0/8", "5.6.7.8"}))
+}
+
+func TestCheckACLShouldNotTrustForwardedIPWithTrustedProxies(t *testing.T) {
+	acl := ACL{&ACEIP{"10.0.0.9"}}
+	trusted := []string{"10.0.0.1"}
+
+	//The header is ignored: the IP has already been resolved through the trusted proxies
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.2:1234"
+	req.Header.Set("X-Forwarded-For", "10.0.0.9")
+	w := httptest.NewRecorder()
+	_, ok := checkACL(acl, "", w, req, trusted)
+	assert.False(t, ok, "check should return false")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	req.RemoteAddr = "10.0.0.9"
+	id, ok := checkACL(acl, "", httptest.NewRecorder(), req, trusted)
+	assert.True(t, ok, "check should return true")
+	assert.Equal(t, "10.0.0.9", id.IP)
+}
@@ -0,0 +1,105 @@
+package wsqueue
+
+import (
+	"math/rand"
+	"time"
+)
+
+//Exponential is an exponential sequence: 2, 4, 8, 16...
+type Exponential struct {
+	i int
+}
+
+//NewExponential returns an Exponential number
+func NewExponential() Exponential {
+	return Exponential{1}
+}
+
+//Next returns the next value
+func (e *Exponential) Next() int {
+	if e.i < maxInt/2 {
+		e.i *= 2
+	}
+	return e.i
+}
+
+//NextDuration returns the next Exponential number cast in the wanted duration
+func (e *Exponential) NextDuration(timeUnit time.Duration) time.Duration {
+	return time.Duration(int(timeUnit) * e.Next())
+}
+
+//BackoffStrategy is the sequence used to compute the delays between connection attempts
+type BackoffStrategy string
+
+const (
+	//BackoffFibonacci waits 2, 3, 5, 8... time units
+	BackoffFibonacci BackoffStrategy = "fibonacci"
+	//BackoffExponential waits 2, 4, 8, 16... time units
+	BackoffExponential BackoffStrategy = "exponential"
+)
+
+//ReconnectPolicy defines how a Client reconnects to a Topic or a Queue
+type ReconnectPolicy struct {
+	//MaxRetries is the max number of connection attempts. -1 means infinite
+	MaxRetries int
+	//Backoff is the backoff strategy. Default is BackoffFibonacci
+	Backoff BackoffStrategy
+	//TimeUnit is the base delay of the backoff. Default is 1s
+	TimeUnit time.Duration
+	//MaxBackoff caps the delay between two attempts. 0 means no limit, see DefaultMaxBackoff
+	MaxBackoff time.Duration
+	//Jitter randomizes each delay by +/- Jitter (between 0 and 1) of its value
+	Jitter float64
+}
+
+//DefaultMaxBackoff is the MaxBackoff of DefaultReconnectPolicy
+const DefaultMaxBackoff = 30 * time.Second
+
+const maxDuration = time.Duration(1<<63 - 1)
+
+//DefaultReconnectPolicy is used by clients without ReconnectPolicy
+var DefaultReconnectPolicy = ReconnectPolicy{
+	MaxRetries: 100,
+	Backoff:    BackoffFibonacci,
+	TimeUnit:   time.Second,
+	MaxBackoff: DefaultMaxBackoff,
+}
+
+type backoff interface {
+	NextDuration(timeUnit time.Duration) time.Duration
+}
+
+//newBackoff returns a function returning the delay before the next attempt
+func (p ReconnectPolicy) newBackoff() func() time.Duration {
+	var b backoff
+	switch p.Backoff {
+	case BackoffExponential:
+		e := NewExponential()
+		b = &e
+	default:
+		f := NewFibonacci()
+		b = &f
+	}
+	timeUnit := p.TimeUnit
+	if timeUnit <= 0 {
+		timeUnit = time.Second
+	}
+	var last time.Duration
+	return func() time.Duration {
+		d := b.NextDuration(timeUnit)
+		//The sequence overflows after a while: the delay saturates instead of wrapping
+		if d <= last {
+			d = maxDuration
+		}
+		last = d
+		if p.MaxBackoff > 0 && d > p.MaxBackoff {
+			d = p.MaxBackoff
+		}
+		if p.Jitter > 0 {
+			if jitter := time.Duration(p.Jitter * float64(d) * (2*rand.Float64() - 1)); jitter < maxDuration-d {
+				d += jitter
+			}
+		}
+		return d
+	}
+}
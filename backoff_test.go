@@ -0,0 +1,41 @@
+package wsqueue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconnectPolicyBackoff(t *testing.T) {
+	next := ReconnectPolicy{Backoff: BackoffExponential, TimeUnit: time.Millisecond, MaxBackoff: 10 * time.Millisecond}.newBackoff()
+	assert.Equal(t, 2*time.Millisecond, next())
+	assert.Equal(t, 4*time.Millisecond, next())
+	assert.Equal(t, 8*time.Millisecond, next())
+	assert.Equal(t, 10*time.Millisecond, next())
+	assert.Equal(t, 10*time.Millisecond, next())
+
+	next = ReconnectPolicy{TimeUnit: time.Millisecond}.newBackoff()
+	assert.Equal(t, 2*time.Millisecond, next())
+	assert.Equal(t, 3*time.Millisecond, next())
+	assert.Equal(t, 5*time.Millisecond, next())
+
+	next = ReconnectPolicy{TimeUnit: time.Second, MaxBackoff: time.Second, Jitter: 0.5}.newBackoff()
+	for i := 0; i < 100; i++ {
+		d := next()
+		assert.True(t, d >= 500*time.Millisecond && d <= 1500*time.Millisecond, "%s out of jitter bounds", d)
+	}
+
+	next = ReconnectPolicy{Backoff: BackoffExponential, TimeUnit: time.Hour}.newBackoff()
+	last := time.Duration(0)
+	for i := 0; i < 100; i++ {
+		d := next()
+		assert.True(t, d >= last, "delay should saturate, got %s after %s", d, last)
+		last = d
+	}
+
+	next = DefaultReconnectPolicy.newBackoff()
+	for i := 0; i < 100; i++ {
+		assert.True(t, next() <= DefaultMaxBackoff)
+	}
+}
@@ -0,0 +1,128 @@
+package wsqueue
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+//ContentTypeBatch is the content-type of the frames holding several messages in Message.Batch
+const ContentTypeBatch = "application/x-wsqueue-batch"
+
+//newBatchMessage returns a frame holding messages
+func newBatchMessage(ms []*Message) *Message {
+	m := Message{
+		Header: Header{},
+		System: SystemHeader{ContentType: ContentTypeBatch},
+		Batch:  make([]Message, 0, len(ms)),
+	}
+	for _, msg := range ms {
+		m.Batch = append(m.Batch, *msg)
+	}
+	return m.stamp()
+}
+
+//IsBatch returns true if the message is a frame holding several messages
+func (m *Message) IsBatch() bool {
+	return m.ContentType() == ContentTypeBatch
+}
+
+//accept prepares new messages according to the options and returns the ones which
+//are not duplicates. If a message is invalid or too large, no message is accepted
+func (o *Options) accept(s *Server, destination string, ms []*Message, cache *dedupCache, store StorageDriver) ([]*Message, error) {
+	max := s.maxMessageSize(o)
+	for _, m := range ms {
+		if max > 0 && len(m.Bytes()) > max {
+			s.oversized()
+			return nil, fmt.Errorf("%w : message %s is %d bytes long, max is %d", ErrMessageTooLarge, m.ID(), len(m.Bytes()), max)
+		}
+	}
+	for _, m := range ms {
+		if err := o.prepare(m, s.keys()); err != nil {
+			if errors.Is(err, ErrInvalidMessage) {
+				o.deadLetter(destination, m, err)
+			}
+			return nil, err
+		}
+	}
+	accepted := make([]*Message, 0, len(ms))
+	for _, m := range ms {
+		if o.duplicate(m, cache, store) {
+			Logfunc("Message %s already sent on %s. Dropping", dedupKey(m), destination)
+			continue
+		}
+		accepted = append(accepted, m)
+	}
+	return accepted, nil
+}
+
+//writeBatch writes messages in a single frame
+func (c *Conn) writeBatch(ms []*Message) error {
+	if len(ms) == 1 {
+		return c.write(ms[0])
+	}
+	return c.write(newBatchMessage(ms))
+}
+
+//buffer adds m to the batch of a queue consumer. The batch is flushed when it is full
+//or after the batch delay of the consumer. The queue mutex must be held
+func (q *Queue) buffer(conn *Conn, m *Message) {
+	q.track(conn, m)
+	conn.batch = append(conn.batch, m)
+	if len(conn.batch) >= conn.BatchSize {
+		q.flush(conn)
+		return
+	}
+	if conn.batchTimer == nil {
+		conn.batchTimer = time.AfterFunc(conn.BatchDelay, func() {
+			q.mutex.Lock()
+			defer q.mutex.Unlock()
+			q.flush(conn)
+		})
+	}
+}
+
+//flush writes the batch of a queue consumer. On failure the connection is closed, so
+//that its messages are requeued. The queue mutex must be held
+func (q *Queue) flush(conn *Conn) {
+	if conn.batchTimer != nil {
+		conn.batchTimer.Stop()
+		conn.batchTimer = nil
+	}
+	batch := conn.batch
+	conn.batch = nil
+	if len(batch) == 0 || q.wsConnections[conn.ID] == nil {
+		return
+	}
+	if err := conn.writeBatch(batch); err != nil {
+		Logfunc("Error while sending to %s : %s", conn.ID, err.Error())
+		conn.WSConn.Close()
+	}
+}
+
+//SendBatch sends messages. The messages sent to the same consumer are written in a
+//single frame up to its batch size, see ListenOptions.BatchSize
+func (q *Queue) SendBatch(data ...interface{}) error {
+	ms := make([]*Message, 0, len(data))
+	for _, d := range data {
+		m, e := newMessage(d)
+		if e != nil {
+			return e
+		}
+		ms = append(ms, m)
+	}
+	return q.postBatch(ms)
+}
+
+//PublishBatch sends messages to everyone in a single frame
+func (t *Topic) PublishBatch(data ...interface{}) error {
+	ms := make([]*Message, 0, len(data))
+	for _, d := range data {
+		m, e := newMessage(d)
+		if e != nil {
+			return e
+		}
+		ms = append(ms, m)
+	}
+	return t.publishBatch(ms)
+}
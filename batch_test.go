@@ -0,0 +1,113 @@
+package wsqueue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchMessageShouldBeEncodedAndDecoded(t *testing.T) {
+	foo, _ := newMessage("foo")
+	bar, _ := newMessage(42)
+	batch := newBatchMessage([]*Message{foo, bar})
+	assert.True(t, batch.IsBatch())
+	for _, codec := range []Codec{JSONCodec, MessagePackCodec, CBORCodec} {
+		b, err := codec.Marshal(batch)
+		assert.NoError(t, err, codec.Name())
+		decoded := &Message{}
+		assert.NoError(t, codec.Unmarshal(b, decoded), codec.Name())
+		assert.True(t, decoded.IsBatch(), codec.Name())
+		assert.Len(t, decoded.Batch, 2, codec.Name())
+		assert.Equal(t, foo.ID(), decoded.Batch[0].ID(), codec.Name())
+		i, err := Decode[int](decoded.Batch[1])
+		assert.NoError(t, err, codec.Name())
+		assert.Equal(t, 42, i, codec.Name())
+	}
+}
+
+func TestSubscribersShouldReceivePublishedBatches(t *testing.T) {
+	s, c, closeFunc := newTestServer(t, "/TestPublishBatch")
+	defer closeFunc()
+	topic := s.CreateTopic("topic")
+	sub, err := c.SubscribeContext(context.Background(), "topic")
+	assert.NoError(t, err)
+	waitForConnections(t, topic, 1)
+
+	assert.NoError(t, topic.PublishBatch("foo", "bar", "baz"))
+	for _, expected := range []string{"foo", "bar", "baz"} {
+		select {
+		case m := <-sub.Messages:
+			assert.Equal(t, expected, m.Text())
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Message %s not received", expected)
+		}
+	}
+}
+
+func TestQueueShouldSendBatchesToConsumers(t *testing.T) {
+	s, c, closeFunc := newTestServer(t, "/TestSendBatch")
+	defer closeFunc()
+	q := s.CreateQueue("queue", 10)
+	sub, err := c.ListenWithOptions(context.Background(), "queue", &ListenOptions{BatchSize: 3, BatchDelay: 50 * time.Millisecond})
+	assert.NoError(t, err)
+	waitForConsumers(t, q, 1)
+
+	q.mutex.RLock()
+	for _, conn := range q.wsConnections {
+		assert.Equal(t, 3, conn.BatchSize)
+		assert.Equal(t, 50*time.Millisecond, conn.BatchDelay)
+	}
+	q.mutex.RUnlock()
+
+	//The last message is sent after the batch delay
+	for _, data := range []string{"a", "b", "c", "d"} {
+		assert.NoError(t, q.Send(data))
+	}
+	assert.NoError(t, q.SendBatch("e", "f"))
+
+	received := []*Message{}
+	texts := []string{}
+	for i := 0; i < 6; i++ {
+		select {
+		case m := <-sub.Messages:
+			received = append(received, &m)
+			texts = append(texts, m.Text())
+		case <-time.After(5 * time.Second):
+			t.Fatal("Message not received")
+		}
+	}
+	assert.ElementsMatch(t, []string{"a", "b", "c", "d", "e", "f"}, texts)
+
+	assert.NoError(t, c.AckBatch(received...))
+	waitForAcks(t, q)
+}
+
+func TestSendBatchShouldFollowTheBatchSizeOfConsumers(t *testing.T) {
+	s, c, closeFunc := newTestServer(t, "/TestSendBatchSize")
+	defer closeFunc()
+	q := s.CreateQueue("queue", 10)
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+c.Host+c.Route+"wsqueue/queue/queue?batch=2&batch_delay=50", nil)
+	assert.NoError(t, err)
+	defer conn.Close()
+	waitForConsumers(t, q, 1)
+
+	//The last message is sent alone after the batch delay
+	assert.NoError(t, q.SendBatch("a", "b", "c"))
+	sizes := []int{}
+	for i := 0; i < 2; i++ {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, data, err := conn.ReadMessage()
+		assert.NoError(t, err)
+		var m Message
+		assert.NoError(t, JSONCodec.Unmarshal(data, &m))
+		if m.IsBatch() {
+			sizes = append(sizes, len(m.Batch))
+		} else {
+			sizes = append(sizes, 1)
+		}
+	}
+	assert.Equal(t, []int{2, 1}, sizes)
+}
@@ -0,0 +1,145 @@
+package wsqueue
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+//ContentTypeChunk is the content-type of the frames holding a part of a large message
+const ContentTypeChunk = "application/x-wsqueue-chunk"
+
+//DefaultChunkTimeout is the default delay after which incomplete chunked messages are discarded
+const DefaultChunkTimeout = 30 * time.Second
+
+//ErrMessageTooLarge is returned when a chunked message exceeds the max message size
+var ErrMessageTooLarge = errors.New("Message too large")
+
+//IsChunk returns true if the message is a part of a large message
+func (m *Message) IsChunk() bool {
+	return m.ContentType() == ContentTypeChunk
+}
+
+//chunks splits an encoded frame bigger than size in chunks encoded with codec
+func chunks(codec Codec, b []byte, size int) ([][]byte, error) {
+	if size <= 0 || len(b) <= size {
+		return [][]byte{b}, nil
+	}
+	id := uuid.NewV4().String()
+	count := (len(b) + size - 1) / size
+	frames := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * size
+		if end > len(b) {
+			end = len(b)
+		}
+		chunk := &Message{
+			System: SystemHeader{
+				ID:          id,
+				ContentType: ContentTypeChunk,
+				ChunkIndex:  i,
+				ChunkCount:  count,
+				ChunkTotal:  len(b),
+			},
+			Raw: b[i*size : end],
+		}
+		frame, err := codec.Marshal(chunk)
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, frame)
+	}
+	return frames, nil
+}
+
+//chunkSet holds the chunks of a message being reassembled
+type chunkSet struct {
+	parts map[int][]byte
+	count int
+	total int
+	//size is the number of bytes received
+	size  int
+	timer *time.Timer
+}
+
+//reassembler rebuilds chunked messages
+type reassembler struct {
+	mutex   *sync.Mutex
+	sets    map[string]*chunkSet
+	maxSize int
+	timeout time.Duration
+}
+
+func newReassembler(maxSize int, timeout time.Duration) *reassembler {
+	if timeout <= 0 {
+		timeout = DefaultChunkTimeout
+	}
+	return &reassembler{
+		mutex:   &sync.Mutex{},
+		sets:    make(map[string]*chunkSet),
+		maxSize: maxSize,
+		timeout: timeout,
+	}
+}
+
+//add adds a chunk to its set. It returns the encoded message once all its chunks are
+//received. On error, the set of the chunk is discarded
+func (r *reassembler) add(m *Message) ([]byte, error) {
+	id, index, count, total := m.ID(), m.System.ChunkIndex, m.System.ChunkCount, m.System.ChunkTotal
+	//A chunk holds at least one byte
+	if count <= 0 || index < 0 || index >= count || count > total {
+		return nil, fmt.Errorf("Invalid chunk %d/%d of message %s", index, count, id)
+	}
+	if r.maxSize > 0 && total > r.maxSize {
+		return nil, fmt.Errorf("%w : message %s is %d bytes long", ErrMessageTooLarge, id, total)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	set, ok := r.sets[id]
+	if !ok {
+		set = &chunkSet{parts: make(map[int][]byte), count: count, total: total}
+		set.timer = time.AfterFunc(r.timeout, func() {
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			if r.sets[id] == set {
+				Warnfunc("Message %s incomplete after %s. Discarding %d chunks", id, r.timeout, len(set.parts))
+				delete(r.sets, id)
+			}
+		})
+		r.sets[id] = set
+	}
+	if set.count != count || set.total != total {
+		r.discard(id, set)
+		return nil, fmt.Errorf("Invalid chunk %d/%d of message %s", index, count, id)
+	}
+	if _, ok := set.parts[index]; !ok {
+		set.parts[index] = m.Raw
+		set.size += len(m.Raw)
+	}
+	if set.size > set.total {
+		r.discard(id, set)
+		return nil, fmt.Errorf("Invalid chunks of message %s : %d bytes received, %d expected", id, set.size, set.total)
+	}
+	if len(set.parts) < count {
+		return nil, nil
+	}
+	r.discard(id, set)
+	if set.size != set.total {
+		return nil, fmt.Errorf("Invalid chunks of message %s : %d bytes received, %d expected", id, set.size, set.total)
+	}
+	b := make([]byte, 0, set.total)
+	for i := 0; i < count; i++ {
+		b = append(b, set.parts[i]...)
+	}
+	return b, nil
+}
+
+//discard forgets the set of a message. The reassembler mutex must be held
+func (r *reassembler) discard(id string, set *chunkSet) {
+	set.timer.Stop()
+	delete(r.sets, id)
+}
@@ -0,0 +1,167 @@
+package wsqueue
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func decodeChunks(t *testing.T, codec Codec, frames [][]byte) []*Message {
+	ms := make([]*Message, 0, len(frames))
+	for _, f := range frames {
+		m := &Message{}
+		assert.NoError(t, codec.Unmarshal(f, m))
+		assert.True(t, m.IsChunk())
+		ms = append(ms, m)
+	}
+	return ms
+}
+
+func TestChunksShouldBeReassembled(t *testing.T) {
+	m, _ := newMessage(strings.Repeat("foo", 100))
+	for _, codec := range []Codec{JSONCodec, MessagePackCodec, CBORCodec} {
+		b, err := codec.Marshal(m)
+		assert.NoError(t, err)
+
+		frames, err := chunks(codec, b, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{b}, frames)
+
+		frames, err = chunks(codec, b, 64)
+		assert.NoError(t, err)
+		assert.True(t, len(frames) > 1, codec.Name())
+		ms := decodeChunks(t, codec, frames)
+
+		r := newReassembler(0, time.Minute)
+		//Chunks may be received in any order
+		for i := len(ms) - 1; i > 0; i-- {
+			p, err := r.add(ms[i])
+			assert.NoError(t, err)
+			assert.Nil(t, p)
+		}
+		p, err := r.add(ms[0])
+		assert.NoError(t, err)
+		assert.Equal(t, b, p, codec.Name())
+		assert.Empty(t, r.sets)
+	}
+}
+
+func TestReassemblerShouldDiscardLargeAndIncompleteMessages(t *testing.T) {
+	m, _ := newMessage(strings.Repeat("foo", 100))
+	b, _ := JSONCodec.Marshal(m)
+	frames, _ := chunks(JSONCodec, b, 64)
+	ms := decodeChunks(t, JSONCodec, frames)
+
+	_, err := newReassembler(100, time.Minute).add(ms[0])
+	assert.True(t, errors.Is(err, ErrMessageTooLarge))
+
+	//The size of a set is checked before its chunks are stored
+	hostile := &Message{System: SystemHeader{ID: "hostile", ContentType: ContentTypeChunk, ChunkCount: 1 << 62, ChunkTotal: 10}, Raw: []byte("foo")}
+	_, err = newReassembler(0, time.Minute).add(hostile)
+	assert.Error(t, err)
+	hostile.System.ChunkTotal = 1 << 62
+	_, err = newReassembler(100, time.Minute).add(hostile)
+	assert.True(t, errors.Is(err, ErrMessageTooLarge))
+
+	//Chunks inconsistent with the first chunk of their set discard the set
+	r := newReassembler(0, time.Minute)
+	_, err = r.add(ms[0])
+	assert.NoError(t, err)
+	forged := *ms[1]
+	forged.System.ChunkCount++
+	forged.System.ChunkTotal++
+	_, err = r.add(&forged)
+	assert.Error(t, err)
+	assert.Empty(t, r.sets)
+
+	//Chunks larger than announced discard the set as soon as they exceed it
+	_, err = r.add(ms[0])
+	assert.NoError(t, err)
+	forged = *ms[1]
+	forged.Raw = make([]byte, ms[1].System.ChunkTotal)
+	_, err = r.add(&forged)
+	assert.Error(t, err)
+	assert.Empty(t, r.sets)
+
+	r = newReassembler(0, 20*time.Millisecond)
+	_, err = r.add(ms[0])
+	assert.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	r.mutex.Lock()
+	assert.Empty(t, r.sets)
+	r.mutex.Unlock()
+}
+
+func TestWriterShouldInterleaveChunks(t *testing.T) {
+	c := &Conn{sendQueue: make(chan frame, 4), closed: make(chan struct{})}
+	assert.NoError(t, c.enqueue(frame{data: []byte("c0"), chunks: [][]byte{[]byte("c1"), []byte("c2")}}))
+	assert.NoError(t, c.enqueue(frame{data: []byte("small")}))
+
+	written := []string{}
+	var pending []frame
+	for len(written) < 4 {
+		f, ok := c.nextFrame(&pending, 4)
+		assert.True(t, ok)
+		written = append(written, string(f.data))
+		if next, ok := f.next(); ok {
+			pending = append(pending, next)
+		}
+	}
+	assert.Equal(t, []string{"c0", "c1", "small", "c2"}, written)
+
+	c.stopWriter()
+	_, ok := c.nextFrame(&pending, 4)
+	assert.False(t, ok)
+}
+
+func TestConsumersShouldReceiveChunkedMessages(t *testing.T) {
+	s, c, closeFunc := newTestServer(t, "/TestChunks")
+	defer closeFunc()
+	q := s.CreateQueue("queue", 10)
+	q.mutex.Lock()
+	q.Options.ChunkSize = 128
+	q.mutex.Unlock()
+
+	sub, err := c.ListenContext(context.Background(), "queue")
+	assert.NoError(t, err)
+	waitForConsumers(t, q, 1)
+
+	body := strings.Repeat("0123456789", 100)
+	assert.NoError(t, q.Send(body))
+	assert.NoError(t, q.Send("small"))
+	//The chunks of body are interleaved with small, which may be received first
+	received := []string{}
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-sub.Messages:
+			received = append(received, m.Text())
+			assert.NoError(t, c.Ack(&m))
+		case err := <-sub.Errors:
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Message not received")
+		}
+	}
+	assert.ElementsMatch(t, []string{body, "small"}, received)
+
+	waitForAcks(t, q)
+	c2 := &Client{Protocol: c.Protocol, Host: c.Host, Route: c.Route, MaxMessageSize: 512}
+	defer c2.Close()
+	sub.Unsubscribe()
+	sub, err = c2.ListenContext(context.Background(), "queue")
+	assert.NoError(t, err)
+	waitForConsumers(t, q, 1)
+	assert.NoError(t, q.Send(body))
+	select {
+	case m := <-sub.Messages:
+		t.Fatalf("Message of %d bytes should be rejected", len(m.Text()))
+	case err := <-sub.Errors:
+		assert.True(t, errors.Is(err, ErrMessageTooLarge))
+	case <-time.After(5 * time.Second):
+		t.Fatal("Error not received")
+	}
+}
@@ -1,10 +1,13 @@
 package wsqueue
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -15,8 +18,70 @@ type Client struct {
 	Protocol string
 	Host     string
 	Route    string
-	dialer   *websocket.Dialer
-	conn     *websocket.Conn
+	//Dialer is the websocket dialer of the client. Default has a 1s handshake timeout
+	Dialer *websocket.Dialer
+	//ReconnectPolicy is used to connect and reconnect. Default is DefaultReconnectPolicy
+	ReconnectPolicy *ReconnectPolicy
+	//Compression enables the negotiation of permessage-deflate with the server
+	Compression *CompressionOptions
+	//Codecs are the codecs accepted by the client, by order of preference. Default is JSONCodec
+	Codecs []Codec
+	//Keyring holds the keys used to decrypt messages and verify their signature
+	Keyring *Keyring
+	//RequireSignature rejects the messages which are not signed
+	RequireSignature bool
+	//MaxFrameSize is the max size of the frames read from the server. 0 means no limit
+	MaxFrameSize int64
+	//MaxMessageSize is the max size of the body of a message, and of a chunked message once reassembled. 0 means no limit
+	MaxMessageSize int
+	//ChunkTimeout is the delay after which incomplete chunked messages are discarded. Default is DefaultChunkTimeout
+	ChunkTimeout time.Duration
+	//PingInterval is the interval between two pings sent to the server. 0 disables pings
+	PingInterval time.Duration
+	//PongTimeout is the delay after which a connection on which neither a pong nor a
+	//message is received is closed and reconnected. Default is twice PingInterval
+	PongTimeout time.Duration
+	//StateHandler is called each time the connection to a Topic or a Queue changes of state
+	StateHandler  func(destination string, state ConnectionState, err error)
+	mutex         sync.Mutex
+	subscriptions map[*Subscription]bool
+	closed        bool
+}
+
+//ConnectionState is the state of the connection of a Subscription
+type ConnectionState string
+
+const (
+	//StateConnecting is sent before each connection attempt
+	StateConnecting ConnectionState = "connecting"
+	//StateConnected is sent when the connection is established
+	StateConnected ConnectionState = "connected"
+	//StateDisconnected is sent when the connection is lost or closed
+	StateDisconnected ConnectionState = "disconnected"
+	//StateGaveUp is sent when the ReconnectPolicy max retries is reached
+	StateGaveUp ConnectionState = "gave-up"
+)
+
+//Subscription is an handle on a connection to a Topic or a Queue. Messages and
+//Errors are closed when the subscription ends
+type Subscription struct {
+	Messages    <-chan Message
+	Errors      <-chan error
+	client      *Client
+	name        string
+	t           wsqueueType
+	options     ListenOptions
+	ctx         context.Context
+	cancel      context.CancelFunc
+	chanMessage chan Message
+	chanError   chan error
+	mutex       sync.Mutex
+	writeMutex  sync.Mutex
+	conn        *websocket.Conn
+	codec       Codec
+	heartbeat   *heartbeat
+	chunks      *reassembler
+	done        chan struct{}
 }
 
 type wsqueueType string
@@ -26,90 +91,435 @@ const (
 	queue             = "queue"
 )
 
+//ListenOptions is options on a Queue consumer
+type ListenOptions struct {
+	//Prefetch is the max number of messages the server sends without acknowledgement. 0 means no limit
+	Prefetch int
+	//Weight is the weight of the consumer if the queue uses a Weighted LoadBalancer
+	Weight int
+	//BatchSize is the max number of messages the server sends in a single frame
+	BatchSize int
+	//BatchDelay is the max delay the server waits for a batch to be complete
+	BatchDelay time.Duration
+}
+
+//ErrClientClosed is returned when subscribing on a closed client
+var ErrClientClosed = errors.New("Client is closed")
+
+//ErrNotConnected is returned when writing on a subscription which is not connected
+var ErrNotConnected = errors.New("Not connected")
+
 //Subscribe aims to connect to a Topic
 func (c *Client) Subscribe(q string) (chan Message, chan error, error) {
+	s, err := c.SubscribeContext(context.Background(), q)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.chanMessage, s.chanError, nil
+}
+
+//SubscribeContext aims to connect to a Topic until ctx is done or the subscription is closed
+func (c *Client) SubscribeContext(ctx context.Context, q string) (*Subscription, error) {
 	Logfunc("Subcribing to Topic %s", q)
-	chanMessage := make(chan Message)
-	chanError := make(chan error)
-	go c.handler(q, chanMessage, chanError, topic)
-	return chanMessage, chanError, nil
+	return c.subscribe(ctx, q, topic, ListenOptions{})
 }
 
 //Listen aims to connect to a Queue
 func (c *Client) Listen(q string) (chan Message, chan error, error) {
+	s, err := c.ListenContext(context.Background(), q)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.chanMessage, s.chanError, nil
+}
+
+//ListenContext aims to connect to a Queue until ctx is done or the subscription is closed
+func (c *Client) ListenContext(ctx context.Context, q string) (*Subscription, error) {
+	return c.ListenWithOptions(ctx, q, nil)
+}
+
+//ListenWithOptions aims to connect to a Queue with options until ctx is done or the subscription is closed
+func (c *Client) ListenWithOptions(ctx context.Context, q string, opts *ListenOptions) (*Subscription, error) {
 	Logfunc("Listening to Queue %s", q)
-	chanMessage := make(chan Message)
-	chanError := make(chan error)
-	go c.handler(q, chanMessage, chanError, queue)
-	return chanMessage, chanError, nil
+	var o ListenOptions
+	if opts != nil {
+		o = *opts
+	}
+	return c.subscribe(ctx, q, queue, o)
+}
+
+func (c *Client) subscribe(ctx context.Context, q string, t wsqueueType, o ListenOptions) (*Subscription, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return nil, ErrClientClosed
+	}
+	if c.subscriptions == nil {
+		c.subscriptions = make(map[*Subscription]bool)
+	}
+
+	s := &Subscription{
+		client:      c,
+		name:        q,
+		t:           t,
+		options:     o,
+		chanMessage: make(chan Message),
+		chanError:   make(chan error),
+		chunks:      newReassembler(c.MaxMessageSize, c.ChunkTimeout),
+		done:        make(chan struct{}),
+	}
+	s.Messages = s.chanMessage
+	s.Errors = s.chanError
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	c.subscriptions[s] = true
+
+	go s.handler()
+	go func() {
+		<-s.ctx.Done()
+		s.disconnect()
+	}()
+	return s, nil
+}
+
+//Close closes all the subscriptions of the client and waits for them to end
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	c.closed = true
+	subscriptions := make([]*Subscription, 0, len(c.subscriptions))
+	for s := range c.subscriptions {
+		subscriptions = append(subscriptions, s)
+	}
+	c.mutex.Unlock()
+
+	for _, s := range subscriptions {
+		s.Unsubscribe()
+	}
+	return nil
+}
+
+//Unsubscribe sends a close frame to the server and waits for the subscription to end
+func (s *Subscription) Unsubscribe() error {
+	s.cancel()
+	<-s.done
+	return nil
+}
+
+//Done is closed when the subscription ends
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+func (c *Client) connect(q string, t wsqueueType, o ListenOptions) (*websocket.Conn, error) {
+	var u = fmt.Sprintf("%s://%s%swsqueue/%s/%s", c.Protocol, c.Host, c.Route, string(t), q)
+	params := url.Values{}
+	if o.Prefetch > 0 {
+		params.Set("prefetch", strconv.Itoa(o.Prefetch))
+	}
+	if o.Weight > 0 {
+		params.Set("weight", strconv.Itoa(o.Weight))
+	}
+	if o.BatchSize > 1 {
+		params.Set("batch", strconv.Itoa(o.BatchSize))
+		params.Set("batch_delay", strconv.FormatInt(o.BatchDelay.Milliseconds(), 10))
+	}
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	dialer := c.Dialer
+	if dialer == nil {
+		dialer = &websocket.Dialer{
+			Proxy:            http.ProxyFromEnvironment,
+			HandshakeTimeout: 1 * time.Second,
+		}
+	}
+
+	if len(c.Codecs) > 0 || c.Compression != nil {
+		d := *dialer
+		d.Subprotocols = subprotocols(c.Codecs)
+		d.EnableCompression = c.Compression != nil
+		dialer = &d
+	}
+
+	Logfunc("Dialing %s", u)
+	conn, _, err := dialer.Dial(u, http.Header{})
+	if err == nil && c.Compression != nil && c.Compression.Level != 0 {
+		conn.SetCompressionLevel(c.Compression.Level)
+	}
+	if err == nil && c.MaxFrameSize > 0 {
+		conn.SetReadLimit(c.MaxFrameSize)
+	}
+	return conn, err
+}
+
+//getConn returns the current connection and its codec
+func (s *Subscription) getConn() (*websocket.Conn, Codec) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.conn, s.codec
 }
 
-func (c *Client) connect(q string, t wsqueueType) error {
-	var url = fmt.Sprintf("%s://%s%swsqueue/%s/%s", c.Protocol, c.Host, c.Route, string(t), q)
-	c.dialer = websocket.DefaultDialer
-	c.dialer.HandshakeTimeout = 1 * time.Second
+func (s *Subscription) setConn(conn *websocket.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.heartbeat.Stop()
+	s.heartbeat = nil
+	s.conn = conn
+}
 
-	Logfunc("Dialing %s", url)
-	var err error
-	c.conn, _, err = c.dialer.Dial(url, http.Header{})
-	return err
+//alive extends the read deadline of the current connection
+func (s *Subscription) alive() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.heartbeat.alive()
+}
+
+//disconnect sends a close frame and closes the current connection
+func (s *Subscription) disconnect() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.conn == nil {
+		return
+	}
+	s.heartbeat.Stop()
+	s.heartbeat = nil
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	s.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	s.conn.Close()
+	s.conn = nil
 }
 
-func (c *Client) reconnect(q string, t wsqueueType, nbRetry int) error {
+func (c *Client) setState(q string, state ConnectionState, err error) {
+	if c.StateHandler != nil {
+		c.StateHandler(q, state, err)
+	}
+}
+
+func (s *Subscription) reconnect() error {
+	policy := DefaultReconnectPolicy
+	if s.client.ReconnectPolicy != nil {
+		policy = *s.client.ReconnectPolicy
+	}
 	var i = 0
-	var f = NewFibonacci()
+	var next = policy.newBackoff()
 	for {
-		if i != -1 && i > nbRetry {
-			Warnfunc("Unable to connect to %s : %s", string(t), q)
-			return fmt.Errorf("Unable to connect to %s : %s", string(t), q)
+		if s.ctx.Err() != nil {
+			return s.ctx.Err()
 		}
-		if c.conn == nil {
-			i++
-			if err := c.connect(q, t); err != nil {
-				Warnfunc("Waiting before retry connection to %s : %s", string(t), q)
-				f.WaitForIt(time.Second)
-			}
-		} else {
+		if conn, _ := s.getConn(); conn != nil {
 			return nil
 		}
+		if policy.MaxRetries != -1 && i > policy.MaxRetries {
+			Warnfunc("Unable to connect to %s : %s", string(s.t), s.name)
+			err := fmt.Errorf("Unable to connect to %s : %s", string(s.t), s.name)
+			s.client.setState(s.name, StateGaveUp, err)
+			return err
+		}
+		i++
+		s.client.setState(s.name, StateConnecting, nil)
+		conn, err := s.client.connect(s.name, s.t, s.options)
+		if err != nil {
+			s.client.setState(s.name, StateDisconnected, err)
+			if policy.MaxRetries != -1 && i > policy.MaxRetries {
+				continue
+			}
+			Warnfunc("Waiting before retry connection to %s : %s", string(s.t), s.name)
+			select {
+			case <-time.After(next()):
+			case <-s.ctx.Done():
+			}
+			continue
+		}
+		s.mutex.Lock()
+		canceled := s.ctx.Err() != nil
+		if !canceled {
+			s.conn = conn
+			s.codec = findCodec(s.client.Codecs, conn.Subprotocol())
+			s.heartbeat = startHeartbeat(conn, s.client.PingInterval, s.client.PongTimeout)
+		}
+		s.mutex.Unlock()
+		if canceled {
+			conn.Close()
+			continue
+		}
+		s.client.setState(s.name, StateConnected, nil)
 	}
 }
 
-func (c *Client) handler(q string, chanMessage chan Message, chanError chan error, t wsqueueType) {
-	Logfunc("Handling message on %s : %s", string(t), q)
+func (s *Subscription) sendError(e error) {
+	select {
+	case s.chanError <- e:
+	case <-s.ctx.Done():
+	}
+}
+
+func (s *Subscription) handler() {
+	Logfunc("Handling message on %s : %s", string(s.t), s.name)
+	defer func() {
+		s.client.mutex.Lock()
+		delete(s.client.subscriptions, s)
+		s.client.mutex.Unlock()
+		s.cancel()
+		close(s.chanError)
+		close(s.chanMessage)
+		close(s.done)
+	}()
 	for {
-		if e := c.reconnect(q, t, 100); e != nil {
-			chanError <- e
-			close(chanError)
-			close(chanMessage)
-			break
+		if e := s.reconnect(); e != nil {
+			if s.ctx.Err() == nil {
+				s.sendError(e)
+			}
+			return
+		}
+		conn, codec := s.getConn()
+		if conn == nil {
+			continue
 		}
-		_, p, e := c.conn.ReadMessage()
+		_, p, e := conn.ReadMessage()
 		if e != nil {
-			c.conn = nil
-			chanError <- e
-			if !websocket.IsUnexpectedCloseError(e, websocket.CloseMessage) {
-				close(chanMessage)
-				close(chanMessage)
-				break
+			if s.ctx.Err() != nil {
+				s.client.setState(s.name, StateDisconnected, nil)
+				return
+			}
+			s.setConn(nil)
+			conn.Close()
+			s.client.setState(s.name, StateDisconnected, e)
+			s.sendError(e)
+			if websocket.IsCloseError(e, websocket.CloseNormalClosure) {
+				return
 			}
 		} else {
-			message := &Message{}
-			if err := json.Unmarshal(p, message); err != nil {
-				log.Println(err)
+			s.alive()
+			frame := &Message{}
+			if err := codec.Unmarshal(p, frame); err != nil {
+				Warnfunc("Cannot Unmarshall message : %s", err.Error())
+				continue
+			}
+			if frame.IsChunk() {
+				b, err := s.chunks.add(frame)
+				if err != nil {
+					s.sendError(err)
+					continue
+				}
+				if b == nil {
+					continue
+				}
+				frame = &Message{}
+				if err := codec.Unmarshal(b, frame); err != nil {
+					Warnfunc("Cannot Unmarshall message : %s", err.Error())
+					continue
+				}
+			}
+			if frame.IsError() {
+				if err := frame.errorResponse(); err != nil {
+					s.sendError(err)
+				}
+				continue
+			}
+			messages := []Message{*frame}
+			if frame.IsBatch() {
+				messages = frame.Batch
+			}
+			for i := range messages {
+				message := &messages[i]
+				if err := message.open(s.client.Keyring, s.client.RequireSignature, s.client.MaxMessageSize); err != nil {
+					s.sendError(err)
+					continue
+				}
+				if max := s.client.MaxMessageSize; max > 0 && len(message.Bytes()) > max {
+					s.sendError(fmt.Errorf("%w : message %s is %d bytes long", ErrMessageTooLarge, message.ID(), len(message.Bytes())))
+					continue
+				}
+				if message.Header == nil {
+					message.Header = Header{}
+				}
+				message.System.Received = time.Now()
+				message.subscription = s
+				select {
+				case s.chanMessage <- *message:
+				case <-s.ctx.Done():
+					return
+				}
 			}
-			message.Header["received"] = time.Now().String()
-			//FIXME: Ack
-			chanMessage <- *message
 		}
 	}
 }
 
+//write sends a message to the server on the current connection
+func (s *Subscription) write(m *Message) error {
+	conn, codec := s.getConn()
+	if conn == nil {
+		return ErrNotConnected
+	}
+	b, err := codec.Marshal(m)
+	if err != nil {
+		return err
+	}
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	if s.client.Compression != nil {
+		conn.EnableWriteCompression(len(b) >= s.client.Compression.Threshold)
+	}
+	return conn.WriteMessage(frameType(codec), b)
+}
+
+//Ack acknowledges a message received from a Queue
 func (c *Client) Ack(msg *Message) error {
+	if msg.subscription == nil || msg.subscription.t != queue {
+		return nil
+	}
+	return msg.subscription.write(&Message{System: SystemHeader{Ack: msg.ID()}})
+}
+
+//Nack rejects a message received from a Queue. The message is requeued by the server
+func (c *Client) Nack(msg *Message) error {
+	if msg.subscription == nil || msg.subscription.t != queue {
+		return nil
+	}
+	return msg.subscription.write(&Message{System: SystemHeader{Nack: msg.ID()}})
+}
+
+//AckBatch acknowledges messages received from Queues. The acks sent to the same
+//Queue are written in a single frame
+func (c *Client) AckBatch(msgs ...*Message) error {
+	return c.writeBatch(msgs, func(m *Message) *Message {
+		return &Message{System: SystemHeader{Ack: m.ID()}}
+	})
+}
+
+//NackBatch rejects messages received from Queues. The nacks sent to the same Queue
+//are written in a single frame
+func (c *Client) NackBatch(msgs ...*Message) error {
+	return c.writeBatch(msgs, func(m *Message) *Message {
+		return &Message{System: SystemHeader{Nack: m.ID()}}
+	})
+}
 
+//writeBatch writes the replies to msgs in a single frame per subscription
+func (c *Client) writeBatch(msgs []*Message, reply func(*Message) *Message) error {
+	batches := make(map[*Subscription][]*Message)
+	order := []*Subscription{}
+	for _, m := range msgs {
+		if m.subscription == nil || m.subscription.t != queue {
+			continue
+		}
+		if batches[m.subscription] == nil {
+			order = append(order, m.subscription)
+		}
+		batches[m.subscription] = append(batches[m.subscription], reply(m))
+	}
+	for _, s := range order {
+		frame := batches[s][0]
+		if len(batches[s]) > 1 {
+			frame = newBatchMessage(batches[s])
+		}
+		if err := s.write(frame); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+//Reply is not implemented yet
 func (c *Client) Reply(msg *Message, response *Message) error {
 
 	return nil
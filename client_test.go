@@ -0,0 +1,136 @@
+package wsqueue
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestServer(t *testing.T, prefix string) (*Server, *Client, func()) {
+	r := mux.NewRouter()
+	s := NewServer(r, prefix)
+	ts := httptest.NewServer(r)
+	c := &Client{
+		Protocol: "ws",
+		Host:     strings.TrimPrefix(ts.URL, "http://"),
+		Route:    prefix + "/",
+	}
+	return s, c, func() {
+		c.Close()
+		ts.Close()
+	}
+}
+
+func waitForConnections(t *testing.T, topic *Topic, n int) {
+	for i := 0; i < 100; i++ {
+		topic.mutex.RLock()
+		l := len(topic.wsConnections)
+		topic.mutex.RUnlock()
+		if l == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %d connections on topic %s", n, topic.Topic)
+}
+
+func TestSubscriptionShouldReceiveMessagesUntilUnsubscribe(t *testing.T) {
+	s, c, closeFunc := newTestServer(t, "/TestUnsubscribe")
+	defer closeFunc()
+	topic := s.CreateTopic("topic")
+
+	sub, err := c.SubscribeContext(context.Background(), "topic")
+	assert.NoError(t, err)
+	waitForConnections(t, topic, 1)
+
+	assert.NoError(t, topic.Publish("Hello"))
+	select {
+	case m := <-sub.Messages:
+		assert.Equal(t, "Hello", m.Body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Message not received")
+	}
+
+	assert.NoError(t, sub.Unsubscribe())
+	_, ok := <-sub.Messages
+	assert.False(t, ok, "Messages should be closed")
+	_, ok = <-sub.Errors
+	assert.False(t, ok, "Errors should be closed")
+	waitForConnections(t, topic, 0)
+	assert.NoError(t, sub.Unsubscribe(), "Unsubscribe twice should not fail")
+}
+
+func TestSubscriptionShouldEndWhenContextIsCanceled(t *testing.T) {
+	s, c, closeFunc := newTestServer(t, "/TestSubscribeContext")
+	defer closeFunc()
+	topic := s.CreateTopic("topic")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sub, err := c.SubscribeContext(ctx, "topic")
+	assert.NoError(t, err)
+	waitForConnections(t, topic, 1)
+
+	cancel()
+	select {
+	case <-sub.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Subscription should be done")
+	}
+	waitForConnections(t, topic, 0)
+}
+
+func TestClientCloseShouldCloseAllSubscriptions(t *testing.T) {
+	s, c, closeFunc := newTestServer(t, "/TestClientClose")
+	defer closeFunc()
+	topic := s.CreateTopic("topic")
+
+	sub1, err := c.SubscribeContext(context.Background(), "topic")
+	assert.NoError(t, err)
+	sub2, err := c.SubscribeContext(context.Background(), "topic")
+	assert.NoError(t, err)
+	waitForConnections(t, topic, 2)
+
+	assert.NoError(t, c.Close())
+	<-sub1.Done()
+	<-sub2.Done()
+	waitForConnections(t, topic, 0)
+
+	_, err = c.SubscribeContext(context.Background(), "topic")
+	assert.Equal(t, ErrClientClosed, err)
+}
+
+func TestSubscriptionShouldGiveUpAccordingToReconnectPolicy(t *testing.T) {
+	var states []ConnectionState
+	c := &Client{
+		Protocol:        "ws",
+		Host:            "localhost:1",
+		Route:           "/",
+		ReconnectPolicy: &ReconnectPolicy{MaxRetries: 2, TimeUnit: time.Millisecond},
+		StateHandler: func(destination string, state ConnectionState, err error) {
+			assert.Equal(t, "topic", destination)
+			states = append(states, state)
+		},
+	}
+	defer c.Close()
+
+	sub, err := c.SubscribeContext(context.Background(), "topic")
+	assert.NoError(t, err)
+	select {
+	case e := <-sub.Errors:
+		assert.Error(t, e)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Subscription should give up")
+	}
+	<-sub.Done()
+	assert.Equal(t, []ConnectionState{
+		StateConnecting, StateDisconnected,
+		StateConnecting, StateDisconnected,
+		StateConnecting, StateDisconnected,
+		StateGaveUp,
+	}, states)
+}
@@ -0,0 +1,105 @@
+package wsqueue
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+//Codec encodes and decodes messages on the wire. Server and Client negotiate the
+//codec with the websocket subprotocol, which is the Name of the codec: the server
+//picks the first codec offered by the client that it supports
+type Codec interface {
+	//Name returns the websocket subprotocol of the codec
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+	//Binary returns true if messages are sent in binary websocket frames
+	Binary() bool
+}
+
+var (
+	//JSONCodec encodes messages in JSON text frames. This is the default codec
+	JSONCodec Codec = jsonCodec{}
+	//MessagePackCodec encodes messages in MessagePack binary frames
+	MessagePackCodec Codec = msgpackCodec{}
+	//CBORCodec encodes messages in CBOR binary frames
+	CBORCodec Codec = cborCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                               { return "wsqueue.json" }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Binary() bool                               { return false }
+
+//msgpackCodec uses json struct tags, so that all codecs share the same field names
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return "wsqueue.msgpack" }
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	err := enc.Encode(v)
+	return buf.Bytes(), err
+}
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+func (msgpackCodec) Binary() bool { return true }
+
+//cborCodec falls back on json struct tags. Times are encoded in RFC3339Nano to keep their nanoseconds
+type cborCodec struct{}
+
+var cborEncMode, _ = cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+
+func (cborCodec) Name() string                               { return "wsqueue.cbor" }
+func (cborCodec) Marshal(v interface{}) ([]byte, error)      { return cborEncMode.Marshal(v) }
+func (cborCodec) Unmarshal(data []byte, v interface{}) error { return cbor.Unmarshal(data, v) }
+func (cborCodec) Binary() bool                               { return true }
+
+//frameType returns the websocket frame type of the codec
+func frameType(c Codec) int {
+	if c.Binary() {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
+}
+
+//findCodec returns the codec named name, or JSONCodec
+func findCodec(codecs []Codec, name string) Codec {
+	for _, c := range codecs {
+		if c.Name() == name {
+			return c
+		}
+	}
+	return JSONCodec
+}
+
+//negotiateCodec returns the first codec offered by the client which is in codecs, or nil
+func negotiateCodec(codecs []Codec, offered []string) Codec {
+	for _, name := range offered {
+		for _, c := range codecs {
+			if c.Name() == name {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+//subprotocols returns the names of codecs
+func subprotocols(codecs []Codec) []string {
+	names := make([]string, len(codecs))
+	for i, c := range codecs {
+		names[i] = c.Name()
+	}
+	return names
+}
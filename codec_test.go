@@ -0,0 +1,92 @@
+package wsqueue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodecsShouldEncodeAndDecodeMessages(t *testing.T) {
+	m, err := newMessage(&testPayload{Name: "foo", Count: 2})
+	assert.NoError(t, err)
+	m.Header["project"] = "foo"
+	m.System.CorrelationID = "bar"
+	m.System.TTL = time.Minute
+	for _, codec := range []Codec{JSONCodec, MessagePackCodec, CBORCodec} {
+		b, err := codec.Marshal(m)
+		assert.NoError(t, err, codec.Name())
+		decoded := &Message{}
+		assert.NoError(t, codec.Unmarshal(b, decoded), codec.Name())
+		assert.Equal(t, m.Header, decoded.Header, codec.Name())
+		assert.True(t, m.System.Timestamp.Equal(decoded.System.Timestamp), codec.Name())
+		decoded.System.Timestamp = m.System.Timestamp
+		assert.Equal(t, m.System, decoded.System, codec.Name())
+		assert.Equal(t, m.Body, decoded.Body, codec.Name())
+	}
+}
+
+func TestSubscribersShouldNegotiateTheirCodec(t *testing.T) {
+	s, c, closeFunc := newTestServer(t, "/TestCodecs")
+	defer closeFunc()
+	topic := s.CreateTopic("topic")
+
+	subs := map[string]*Subscription{}
+	for _, codec := range []Codec{JSONCodec, MessagePackCodec, CBORCodec} {
+		client := &Client{Protocol: c.Protocol, Host: c.Host, Route: c.Route, Codecs: []Codec{codec}}
+		defer client.Close()
+		sub, err := client.SubscribeContext(context.Background(), "topic")
+		assert.NoError(t, err)
+		subs[codec.Name()] = sub
+	}
+	waitForConnections(t, topic, 3)
+
+	topic.mutex.RLock()
+	names := map[string]bool{}
+	for _, conn := range topic.wsConnections {
+		names[conn.Codec().Name()] = true
+	}
+	topic.mutex.RUnlock()
+	assert.Equal(t, map[string]bool{"wsqueue.json": true, "wsqueue.msgpack": true, "wsqueue.cbor": true}, names)
+
+	assert.NoError(t, Publish(topic, testPayload{Name: "foo", Count: 2}))
+	for name, sub := range subs {
+		select {
+		case m := <-sub.Messages:
+			p, err := Decode[testPayload](m)
+			assert.NoError(t, err, name)
+			assert.Equal(t, testPayload{Name: "foo", Count: 2}, p, name)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Message not received with codec %s", name)
+		}
+	}
+}
+
+func TestServerShouldNegotiateTheCodecPreferredByTheClient(t *testing.T) {
+	s, c, closeFunc := newTestServer(t, "/TestCodecPreference")
+	defer closeFunc()
+	topic := s.CreateTopic("topic")
+
+	client := &Client{Protocol: c.Protocol, Host: c.Host, Route: c.Route, Codecs: []Codec{MessagePackCodec, JSONCodec}}
+	defer client.Close()
+	sub, err := client.SubscribeContext(context.Background(), "topic")
+	assert.NoError(t, err)
+	waitForConnections(t, topic, 1)
+
+	topic.mutex.RLock()
+	for _, conn := range topic.wsConnections {
+		assert.Equal(t, MessagePackCodec, conn.Codec())
+	}
+	topic.mutex.RUnlock()
+
+	assert.NoError(t, topic.Publish("foo"))
+	select {
+	case m := <-sub.Messages:
+		assert.Equal(t, "foo", m.Text())
+	case <-time.After(5 * time.Second):
+		t.Fatal("Message not received")
+	}
+	_, codec := sub.getConn()
+	assert.Equal(t, MessagePackCodec, codec)
+}
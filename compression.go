@@ -0,0 +1,140 @@
+package wsqueue
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+//CompressionOptions configures the permessage-deflate websocket extension
+type CompressionOptions struct {
+	//Level is the flate compression level, from -2 to 9. 0 means the default level
+	Level int
+	//Threshold is the min size of the frames to compress
+	Threshold int
+}
+
+const (
+	//EncodingGzip is the gzip content-encoding of messages
+	EncodingGzip = "gzip"
+	//EncodingZstd is the zstd content-encoding of messages
+	EncodingZstd = "zstd"
+)
+
+//zstdMaxWindow is the window of the default zstd encoders
+const zstdMaxWindow = 8 << 20
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+func initZstd() {
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+}
+
+//isText checks if a content-type is sent in Message.Body
+func isText(contentType string) bool {
+	switch contentType {
+	case "string", "int", "uint", "float", "bool", "application/json":
+		return true
+	}
+	return strings.HasPrefix(contentType, "text/")
+}
+
+//compress compresses the payload of m in Raw and sets its content-encoding
+func (m *Message) compress(encoding string) error {
+	var b []byte
+	switch encoding {
+	case EncodingGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(m.Bytes()); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		b = buf.Bytes()
+	case EncodingZstd:
+		zstdOnce.Do(initZstd)
+		b = zstdEncoder.EncodeAll(m.Bytes(), nil)
+	default:
+		return fmt.Errorf("Unsupported content-encoding %s", encoding)
+	}
+	m.System.ContentEncoding = encoding
+	m.Body = ""
+	m.Raw = b
+	return nil
+}
+
+//decompress decompresses the payload of m according to its content-encoding. If max is
+//positive, decompression stops with ErrMessageTooLarge once the payload exceeds max bytes
+func (m *Message) decompress(max int) error {
+	encoding := m.System.ContentEncoding
+	if encoding == "" {
+		return nil
+	}
+	var r io.Reader
+	switch encoding {
+	case EncodingGzip:
+		gz, err := gzip.NewReader(bytes.NewReader(m.Raw))
+		if err != nil {
+			return err
+		}
+		r = gz
+	case EncodingZstd:
+		if max <= 0 {
+			zstdOnce.Do(initZstd)
+			b, err := zstdDecoder.DecodeAll(m.Raw, nil)
+			if err != nil {
+				return err
+			}
+			return m.decompressed(b)
+		}
+		//The window of the default zstd encoders is allowed, whatever max
+		memory := uint64(max) + 1
+		if memory < zstdMaxWindow {
+			memory = zstdMaxWindow
+		}
+		zr, err := zstd.NewReader(bytes.NewReader(m.Raw), zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(memory))
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return fmt.Errorf("Unsupported content-encoding %s", encoding)
+	}
+	if max > 0 {
+		r = io.LimitReader(r, int64(max)+1)
+	}
+	b, err := io.ReadAll(r)
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) || (max > 0 && len(b) > max) {
+		return fmt.Errorf("%w : message %s is more than %d bytes long once decompressed", ErrMessageTooLarge, m.ID(), max)
+	}
+	if err != nil {
+		return err
+	}
+	return m.decompressed(b)
+}
+
+//decompressed sets the decompressed payload of m
+func (m *Message) decompressed(b []byte) error {
+	m.System.ContentEncoding = ""
+	if isText(m.ContentType()) {
+		m.Body = string(b)
+		m.Raw = nil
+	} else {
+		m.Raw = b
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package wsqueue
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessagesShouldBeCompressedAndDecompressed(t *testing.T) {
+	for _, encoding := range []string{EncodingGzip, EncodingZstd} {
+		text, _ := newMessage(strings.Repeat("foo", 100))
+		assert.NoError(t, text.compress(encoding), encoding)
+		assert.Equal(t, encoding, text.System.ContentEncoding)
+		assert.Empty(t, text.Body)
+		assert.True(t, len(text.Raw) < 300, encoding)
+		assert.NoError(t, text.decompress(0), encoding)
+		assert.Equal(t, strings.Repeat("foo", 100), text.Text())
+		assert.Nil(t, text.Raw)
+
+		binary := newBinaryMessage("image/png", []byte{1, 2, 3, 4})
+		assert.NoError(t, binary.compress(encoding), encoding)
+		assert.NoError(t, binary.decompress(0), encoding)
+		assert.Equal(t, []byte{1, 2, 3, 4}, binary.Bytes())
+		assert.Empty(t, binary.System.ContentEncoding)
+	}
+
+	m, _ := newMessage("foo")
+	assert.Error(t, m.compress("deflate"))
+}
+
+func TestDecompressionShouldBeBounded(t *testing.T) {
+	for _, encoding := range []string{EncodingGzip, EncodingZstd} {
+		bomb := newBinaryMessage("", make([]byte, 4<<20))
+		assert.NoError(t, bomb.compress(encoding), encoding)
+		assert.True(t, len(bomb.Raw) < 1<<20, encoding)
+		compressed := bomb.Raw
+		assert.True(t, errors.Is(bomb.decompress(1024), ErrMessageTooLarge), encoding)
+
+		bomb.Raw = compressed
+		assert.NoError(t, bomb.decompress(4<<20), encoding)
+		assert.Len(t, bomb.Raw, 4<<20, encoding)
+	}
+}
+
+func TestSubscribersShouldReceiveCompressedMessages(t *testing.T) {
+	s, c, closeFunc := newTestServer(t, "/TestCompression")
+	defer closeFunc()
+	s.Compression = &CompressionOptions{Threshold: 64}
+	c.Compression = &CompressionOptions{Threshold: 64}
+	topic := s.CreateTopic("topic")
+	topic.mutex.Lock()
+	topic.Options = &Options{ContentEncoding: EncodingZstd, ContentEncodingThreshold: 64}
+	topic.mutex.Unlock()
+
+	sub, err := c.SubscribeContext(context.Background(), "topic")
+	assert.NoError(t, err)
+	waitForConnections(t, topic, 1)
+
+	body := strings.Repeat("bar", 100)
+	assert.NoError(t, topic.Publish(body))
+	assert.NoError(t, topic.Publish("small"))
+	for _, expected := range []string{body, "small"} {
+		select {
+		case m := <-sub.Messages:
+			assert.Equal(t, expected, m.Text())
+			assert.Empty(t, m.System.ContentEncoding)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Message not received")
+		}
+	}
+}
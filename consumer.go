@@ -0,0 +1,83 @@
+package wsqueue
+
+import "context"
+
+//ConsumeOptions is options on a consumer
+type ConsumeOptions struct {
+	//Workers is the number of messages handled concurrently. Default is 1
+	Workers int
+	//Prefetch is the max number of messages received and not yet acknowledged. Default is Workers
+	Prefetch int
+	//Weight is the weight of the consumer if the queue uses a Weighted LoadBalancer
+	Weight int
+	//ErrorHandler is called with the errors of the subscription. Default logs them with Warnfunc
+	ErrorHandler func(error)
+}
+
+//HandlerFunc handles a message received from a Queue. If it returns nil, the message is
+//acknowledged, else it is rejected and requeued by the server
+type HandlerFunc func(*Message) error
+
+//Consume listens to a Queue and calls handler for each message
+func (c *Client) Consume(q string, handler HandlerFunc, opts *ConsumeOptions) (*Subscription, error) {
+	return c.ConsumeContext(context.Background(), q, handler, opts)
+}
+
+//ConsumeContext listens to a Queue and calls handler for each message until ctx is done
+//or the subscription is closed
+func (c *Client) ConsumeContext(ctx context.Context, q string, handler HandlerFunc, opts *ConsumeOptions) (*Subscription, error) {
+	var o ConsumeOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.Workers < 1 {
+		o.Workers = 1
+	}
+	if o.Prefetch < o.Workers {
+		o.Prefetch = o.Workers
+	}
+	if o.ErrorHandler == nil {
+		o.ErrorHandler = func(e error) {
+			Warnfunc("Error while consuming %s : %s", q, e.Error())
+		}
+	}
+
+	s, err := c.ListenWithOptions(ctx, q, &ListenOptions{Prefetch: o.Prefetch, Weight: o.Weight})
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for e := range s.Errors {
+			o.ErrorHandler(e)
+		}
+	}()
+
+	//credits limits the number of messages received and not yet acknowledged
+	credits := make(chan struct{}, o.Prefetch)
+	jobs := make(chan Message, o.Prefetch)
+	go func() {
+		defer close(jobs)
+		for m := range s.Messages {
+			credits <- struct{}{}
+			jobs <- m
+		}
+	}()
+
+	for i := 0; i < o.Workers; i++ {
+		go func() {
+			for m := range jobs {
+				if err := handler(&m); err != nil {
+					Warnfunc("Message %s rejected : %s", m.ID(), err.Error())
+					if e := c.Nack(&m); e != nil {
+						o.ErrorHandler(e)
+					}
+				} else if e := c.Ack(&m); e != nil {
+					o.ErrorHandler(e)
+				}
+				<-credits
+			}
+		}()
+	}
+	return s, nil
+}
@@ -0,0 +1,265 @@
+package wsqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func waitForConsumers(t *testing.T, q *Queue, n int) {
+	for i := 0; i < 100; i++ {
+		q.mutex.RLock()
+		l := len(q.wsConnections)
+		q.mutex.RUnlock()
+		if l == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %d consumers on queue %s", n, q.Queue)
+}
+
+func waitForAcks(t *testing.T, q *Queue) {
+	for i := 0; i < 100; i++ {
+		q.mutex.RLock()
+		n := 0
+		for _, inflight := range q.inflight {
+			n += len(inflight)
+		}
+		q.mutex.RUnlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Messages not acknowledged on queue %s", q.Queue)
+}
+
+func TestConsumeShouldAckAndRedeliverNackedMessages(t *testing.T) {
+	s, c, closeFunc := newTestServer(t, "/TestConsume")
+	defer closeFunc()
+	q := s.CreateQueue("queue", 10)
+
+	mutex := &sync.Mutex{}
+	received := map[string]int{}
+	done := make(chan bool)
+	sub, err := c.Consume("queue", func(m *Message) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		received[m.Body]++
+		if m.Body == "fail once" && received[m.Body] == 1 {
+			return errors.New("failed")
+		}
+		if len(received) == 3 && received["fail once"] == 2 {
+			close(done)
+		}
+		return nil
+	}, &ConsumeOptions{Workers: 2})
+	assert.NoError(t, err)
+	waitForConsumers(t, q, 1)
+
+	assert.NoError(t, q.Send("foo"))
+	assert.NoError(t, q.Send("fail once"))
+	assert.NoError(t, q.Send("bar"))
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Messages not consumed")
+	}
+
+	waitForAcks(t, q)
+	assert.NoError(t, sub.Unsubscribe())
+}
+
+func TestQueueShouldNotSendMoreThanPrefetch(t *testing.T) {
+	s, c, closeFunc := newTestServer(t, "/TestPrefetch")
+	defer closeFunc()
+	q := s.CreateQueue("queue", 10)
+
+	sub, err := c.ListenWithOptions(context.Background(), "queue", &ListenOptions{Prefetch: 1})
+	assert.NoError(t, err)
+	waitForConsumers(t, q, 1)
+
+	assert.NoError(t, q.Send("foo"))
+	assert.NoError(t, q.Send("bar"))
+
+	var m Message
+	select {
+	case m = <-sub.Messages:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Message not received")
+	}
+
+	select {
+	case m2 := <-sub.Messages:
+		t.Fatalf("Message %s should not be received before ack", m2.Body)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	assert.NoError(t, c.Ack(&m))
+	select {
+	case m2 := <-sub.Messages:
+		assert.NotEqual(t, m.Body, m2.Body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Message not received after ack")
+	}
+}
+
+func TestAcksShouldNotBeRateLimited(t *testing.T) {
+	s, c, closeFunc := newTestServer(t, "/TestAckRateLimit")
+	defer closeFunc()
+	q := s.CreateQueue("queue", 10)
+	q.mutex.Lock()
+	q.Options.Limits = LimitOptions{MessageRate: 0.001}
+	q.mutex.Unlock()
+
+	sub, err := c.ListenWithOptions(context.Background(), "queue", &ListenOptions{Prefetch: 1})
+	assert.NoError(t, err)
+	waitForConsumers(t, q, 1)
+
+	rejected := s.RejectedMessagesCounter.Value()
+	for _, data := range []string{"foo", "bar", "baz"} {
+		assert.NoError(t, q.Send(data))
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case m := <-sub.Messages:
+			assert.NoError(t, c.Ack(&m))
+		case <-time.After(5 * time.Second):
+			t.Fatal("Message not received after ack")
+		}
+	}
+	waitForAcks(t, q)
+	assert.Equal(t, rejected, s.RejectedMessagesCounter.Value())
+}
+
+func TestOrderedQueueShouldDeliverPartitionsInOrder(t *testing.T) {
+	s, c, closeFunc := newTestServer(t, "/TestOrdered")
+	defer closeFunc()
+	q := s.CreateQueue("queue", 100)
+	q.Options.Ordered = true
+
+	mutex := &sync.Mutex{}
+	received := map[string][]string{}
+	consumers := map[string]map[*Subscription]bool{}
+	done, again := make(chan bool), make(chan bool)
+	handler := func(m *Message) error {
+		time.Sleep(time.Millisecond)
+		mutex.Lock()
+		defer mutex.Unlock()
+		key := m.Header[HeaderPartitionKey]
+		received[key] = append(received[key], m.Body)
+		if consumers[key] == nil {
+			consumers[key] = map[*Subscription]bool{}
+		}
+		consumers[key][m.subscription] = true
+		if len(received["p1"]) == 10 && len(received["p2"]) == 10 {
+			close(done)
+		}
+		if len(received["p1"]) == 20 && len(received["p2"]) == 20 {
+			close(again)
+		}
+		return nil
+	}
+	_, err := c.Consume("queue", handler, &ConsumeOptions{Workers: 4})
+	assert.NoError(t, err)
+	_, err = c.Consume("queue", handler, &ConsumeOptions{Workers: 4})
+	assert.NoError(t, err)
+	waitForConsumers(t, q, 2)
+
+	expected := []string{}
+	for i := 0; i < 10; i++ {
+		expected = append(expected, fmt.Sprintf("%d", i))
+		assert.NoError(t, q.SendWithKey("p1", fmt.Sprintf("%d", i)))
+		assert.NoError(t, q.SendWithKey("p2", fmt.Sprintf("%d", i)))
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Messages not consumed")
+	}
+
+	//Idle partitions are deleted, their keys stay on the same consumer
+	waitForAcks(t, q)
+	q.mutex.RLock()
+	assert.Empty(t, q.partitions)
+	q.mutex.RUnlock()
+	for i := 10; i < 20; i++ {
+		expected = append(expected, fmt.Sprintf("%d", i))
+		assert.NoError(t, q.SendWithKey("p2", fmt.Sprintf("%d", i)))
+		assert.NoError(t, q.SendWithKey("p1", fmt.Sprintf("%d", i)))
+	}
+	select {
+	case <-again:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Messages not consumed")
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, expected, received["p1"])
+	assert.Equal(t, expected, received["p2"])
+	assert.Len(t, consumers["p1"], 1, "partition should stick to one consumer")
+	assert.Len(t, consumers["p2"], 1, "partition should stick to one consumer")
+}
+
+func TestOrderedQueueShouldDeleteIdlePartitions(t *testing.T) {
+	s, c, closeFunc := newTestServer(t, "/TestIdlePartitions")
+	defer closeFunc()
+	q := s.CreateQueue("queue", 2)
+	q.Options.Ordered = true
+
+	//Without consumer, the partitions are full after 2 messages
+	assert.NoError(t, q.SendWithKey("p1", "foo"))
+	assert.NoError(t, q.SendWithKey("p2", "bar"))
+	sent := make(chan bool)
+	go func() {
+		assert.NoError(t, q.SendWithKey("p3", "baz"))
+		close(sent)
+	}()
+	select {
+	case <-sent:
+		t.Fatal("Send should wait for room in the partitions")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	sub, err := c.ListenContext(context.Background(), "queue")
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		select {
+		case m := <-sub.Messages:
+			assert.NoError(t, c.Ack(&m))
+		case <-time.After(5 * time.Second):
+			t.Fatal("Message not received")
+		}
+	}
+	<-sent
+	waitForAcks(t, q)
+	q.mutex.RLock()
+	assert.Empty(t, q.partitions, "idle partitions should be deleted")
+	q.mutex.RUnlock()
+}
+
+func TestPartitionOwnersShouldBeBounded(t *testing.T) {
+	o := newPartitionOwners()
+	o.set("p1", "c1", 2)
+	o.set("p2", "c2", 2)
+	o.set("p1", "c1", 2)
+	o.set("p3", "c1", 2)
+	_, ok := o.get("p2")
+	assert.False(t, ok, "least recently set key should be evicted")
+	id, ok := o.get("p1")
+	assert.True(t, ok)
+	assert.Equal(t, ConnID("c1"), id)
+
+	o.leave("c1")
+	assert.Empty(t, o.entries, "keys of an exited consumer should be forgotten")
+	assert.Equal(t, 0, o.order.Len())
+}
@@ -0,0 +1,293 @@
+package wsqueue
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	//AlgorithmAESGCM encrypts payloads with AES-GCM. Keys are 16, 24 or 32 bytes long
+	AlgorithmAESGCM = "aes-gcm"
+	//AlgorithmSecretbox encrypts payloads with NaCl secretbox. Keys are 32 bytes long
+	AlgorithmSecretbox = "secretbox"
+	//AlgorithmHMAC signs messages with HMAC-SHA256
+	AlgorithmHMAC = "hmac-sha256"
+	//AlgorithmEd25519 signs messages with Ed25519. Producers need the private key,
+	//consumers only need the public key
+	AlgorithmEd25519 = "ed25519"
+)
+
+var (
+	//ErrUnknownKey is returned when a message refers to a key missing in the keyring
+	ErrUnknownKey = errors.New("Unknown key")
+	//ErrInvalidSignature is returned when the signature of a message cannot be verified
+	ErrInvalidSignature = errors.New("Invalid signature")
+)
+
+//Key is an encryption or a signing key
+type Key struct {
+	ID        string
+	Algorithm string
+	Secret    []byte
+}
+
+//Keyring holds the keys of a Server or a Client, by ID. Keys may be added while
+//the server is running, for instance to rotate them
+type Keyring struct {
+	mutex *sync.RWMutex
+	keys  map[string]Key
+}
+
+//NewKeyring returns a keyring holding keys
+func NewKeyring(keys ...Key) (*Keyring, error) {
+	k := &Keyring{
+		mutex: &sync.RWMutex{},
+		keys:  make(map[string]Key),
+	}
+	for _, key := range keys {
+		if err := k.Add(key); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+//Add checks a key and adds it to the keyring. It replaces any key with the same ID
+func (k *Keyring) Add(key Key) error {
+	var valid bool
+	switch key.Algorithm {
+	case AlgorithmAESGCM:
+		valid = len(key.Secret) == 16 || len(key.Secret) == 24 || len(key.Secret) == 32
+	case AlgorithmSecretbox:
+		valid = len(key.Secret) == 32
+	case AlgorithmHMAC:
+		valid = len(key.Secret) > 0
+	case AlgorithmEd25519:
+		valid = len(key.Secret) == ed25519.PrivateKeySize || len(key.Secret) == ed25519.PublicKeySize
+	default:
+		return fmt.Errorf("Unsupported algorithm %s", key.Algorithm)
+	}
+	if !valid {
+		return fmt.Errorf("Invalid %s key %s", key.Algorithm, key.ID)
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.keys[key.ID] = key
+	return nil
+}
+
+func (k *Keyring) get(id string) (Key, error) {
+	if k == nil {
+		return Key{}, fmt.Errorf("%w %s", ErrUnknownKey, id)
+	}
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	key, ok := k.keys[id]
+	if !ok {
+		return Key{}, fmt.Errorf("%w %s", ErrUnknownKey, id)
+	}
+	return key, nil
+}
+
+//encrypt encrypts the payload of m in Raw with the key keyID
+func (m *Message) encrypt(keys *Keyring, keyID string) error {
+	key, err := keys.get(keyID)
+	if err != nil {
+		return err
+	}
+	var b []byte
+	switch key.Algorithm {
+	case AlgorithmAESGCM:
+		gcm, err := newGCM(key.Secret)
+		if err != nil {
+			return err
+		}
+		nonce := make([]byte, gcm.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return err
+		}
+		b = gcm.Seal(nonce, nonce, m.Bytes(), nil)
+	case AlgorithmSecretbox:
+		var nonce [24]byte
+		if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+			return err
+		}
+		var secret [32]byte
+		copy(secret[:], key.Secret)
+		b = secretbox.Seal(nonce[:], m.Bytes(), &nonce, &secret)
+	default:
+		return fmt.Errorf("Cannot encrypt with %s key %s", key.Algorithm, keyID)
+	}
+	m.System.EncryptionKey = keyID
+	m.Body = ""
+	m.Raw = b
+	return nil
+}
+
+//decrypt decrypts the payload of m according to its encryption key
+func (m *Message) decrypt(keys *Keyring) error {
+	if m.System.EncryptionKey == "" {
+		return nil
+	}
+	key, err := keys.get(m.System.EncryptionKey)
+	if err != nil {
+		return err
+	}
+	var b []byte
+	switch key.Algorithm {
+	case AlgorithmAESGCM:
+		gcm, err := newGCM(key.Secret)
+		if err != nil {
+			return err
+		}
+		if len(m.Raw) < gcm.NonceSize() {
+			return errors.New("Cannot decrypt message : payload too short")
+		}
+		nonce := m.Raw[:gcm.NonceSize()]
+		if b, err = gcm.Open(nil, nonce, m.Raw[gcm.NonceSize():], nil); err != nil {
+			return err
+		}
+	case AlgorithmSecretbox:
+		if len(m.Raw) < 24 {
+			return errors.New("Cannot decrypt message : payload too short")
+		}
+		var nonce [24]byte
+		var secret [32]byte
+		copy(nonce[:], m.Raw[:24])
+		copy(secret[:], key.Secret)
+		var ok bool
+		if b, ok = secretbox.Open(nil, m.Raw[24:], &nonce, &secret); !ok {
+			return errors.New("Cannot decrypt message")
+		}
+	default:
+		return fmt.Errorf("Cannot decrypt with %s key %s", key.Algorithm, key.ID)
+	}
+	m.System.EncryptionKey = ""
+	if m.System.ContentEncoding == "" && isText(m.ContentType()) {
+		m.Body = string(b)
+		m.Raw = nil
+	} else {
+		m.Raw = b
+	}
+	return nil
+}
+
+func newGCM(secret []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//digest returns the signed content of m: its system headers, its user headers and its payload
+func (m *Message) digest() []byte {
+	var buf bytes.Buffer
+	write := func(s string) {
+		binary.Write(&buf, binary.BigEndian, uint32(len(s)))
+		buf.WriteString(s)
+	}
+	write(m.System.ID)
+	write(m.System.Timestamp.UTC().Format(time.RFC3339Nano))
+	write(m.System.Host)
+	write(m.System.CorrelationID)
+	write(m.System.TTL.String())
+	write(m.System.ContentType)
+	write(m.System.ApplicationType)
+	write(m.System.ContentEncoding)
+	write(m.System.EncryptionKey)
+	write(m.System.SignatureKey)
+	keys := make([]string, 0, len(m.Header))
+	for k := range m.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		write(k)
+		write(m.Header[k])
+	}
+	write(string(m.Bytes()))
+	return buf.Bytes()
+}
+
+//sign signs m with the key keyID
+func (m *Message) sign(keys *Keyring, keyID string) error {
+	key, err := keys.get(keyID)
+	if err != nil {
+		return err
+	}
+	m.System.SignatureKey = keyID
+	switch key.Algorithm {
+	case AlgorithmHMAC:
+		mac := hmac.New(sha256.New, key.Secret)
+		mac.Write(m.digest())
+		m.System.Signature = mac.Sum(nil)
+	case AlgorithmEd25519:
+		if len(key.Secret) != ed25519.PrivateKeySize {
+			return fmt.Errorf("Cannot sign with ed25519 public key %s", keyID)
+		}
+		m.System.Signature = ed25519.Sign(ed25519.PrivateKey(key.Secret), m.digest())
+	default:
+		return fmt.Errorf("Cannot sign with %s key %s", key.Algorithm, keyID)
+	}
+	return nil
+}
+
+//verify checks the signature of m. Unsigned messages are rejected if required is true
+func (m *Message) verify(keys *Keyring, required bool) error {
+	if m.System.SignatureKey == "" {
+		if required {
+			return fmt.Errorf("%w : message %s is not signed", ErrInvalidSignature, m.ID())
+		}
+		return nil
+	}
+	key, err := keys.get(m.System.SignatureKey)
+	if err != nil {
+		return err
+	}
+	var valid bool
+	switch key.Algorithm {
+	case AlgorithmHMAC:
+		mac := hmac.New(sha256.New, key.Secret)
+		mac.Write(m.digest())
+		valid = hmac.Equal(mac.Sum(nil), m.System.Signature)
+	case AlgorithmEd25519:
+		public := ed25519.PublicKey(key.Secret)
+		if len(key.Secret) == ed25519.PrivateKeySize {
+			public = ed25519.PrivateKey(key.Secret).Public().(ed25519.PublicKey)
+		}
+		valid = ed25519.Verify(public, m.digest(), m.System.Signature)
+	default:
+		return fmt.Errorf("Cannot verify with %s key %s", key.Algorithm, key.ID)
+	}
+	if !valid {
+		return fmt.Errorf("%w : message %s signed by %s", ErrInvalidSignature, m.ID(), key.ID)
+	}
+	return nil
+}
+
+//open verifies, decrypts and decompresses a received message. The decompressed payload
+//is limited to max bytes if max is positive
+func (m *Message) open(keys *Keyring, requireSignature bool, max int) error {
+	if err := m.verify(keys, requireSignature); err != nil {
+		return err
+	}
+	if err := m.decrypt(keys); err != nil {
+		return err
+	}
+	return m.decompress(max)
+}
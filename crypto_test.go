@@ -0,0 +1,130 @@
+package wsqueue
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessagesShouldBeEncryptedAndDecrypted(t *testing.T) {
+	keys, err := NewKeyring(
+		Key{ID: "aes", Algorithm: AlgorithmAESGCM, Secret: bytes.Repeat([]byte{1}, 32)},
+		Key{ID: "box", Algorithm: AlgorithmSecretbox, Secret: bytes.Repeat([]byte{2}, 32)},
+	)
+	assert.NoError(t, err)
+	assert.Error(t, keys.Add(Key{ID: "short", Algorithm: AlgorithmSecretbox, Secret: []byte{1}}))
+
+	for _, id := range []string{"aes", "box"} {
+		m, _ := newMessage("secret")
+		assert.NoError(t, m.encrypt(keys, id), id)
+		assert.Equal(t, id, m.System.EncryptionKey)
+		assert.Empty(t, m.Body)
+		assert.NotContains(t, string(m.Raw), "secret")
+		assert.NoError(t, m.open(keys, false, 0), id)
+		assert.Equal(t, "secret", m.Text())
+		assert.False(t, m.IsBinary())
+
+		m, _ = newMessage(strings.Repeat("secret", 100))
+		assert.NoError(t, m.compress(EncodingGzip))
+		assert.NoError(t, m.encrypt(keys, id), id)
+		assert.NoError(t, m.open(keys, false, 0), id)
+		assert.Equal(t, strings.Repeat("secret", 100), m.Text())
+
+		m, _ = newMessage("secret")
+		assert.NoError(t, m.encrypt(keys, id), id)
+		m.Raw[len(m.Raw)-1]++
+		assert.Error(t, m.open(keys, false, 0), id)
+	}
+
+	m, _ := newMessage("secret")
+	assert.True(t, errors.Is(m.encrypt(keys, "unknown"), ErrUnknownKey))
+}
+
+func TestMessagesShouldBeSignedAndVerified(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	producer, err := NewKeyring(
+		Key{ID: "hmac", Algorithm: AlgorithmHMAC, Secret: []byte("secret")},
+		Key{ID: "ed25519", Algorithm: AlgorithmEd25519, Secret: private},
+	)
+	assert.NoError(t, err)
+	consumer, err := NewKeyring(
+		Key{ID: "hmac", Algorithm: AlgorithmHMAC, Secret: []byte("secret")},
+		Key{ID: "ed25519", Algorithm: AlgorithmEd25519, Secret: public},
+	)
+	assert.NoError(t, err)
+
+	for _, id := range []string{"hmac", "ed25519"} {
+		m, _ := newMessage("foo")
+		m.Header["project"] = "bar"
+		assert.NoError(t, m.sign(producer, id), id)
+		for _, codec := range []Codec{JSONCodec, MessagePackCodec, CBORCodec} {
+			b, err := codec.Marshal(m)
+			assert.NoError(t, err)
+			decoded := &Message{}
+			assert.NoError(t, codec.Unmarshal(b, decoded))
+			assert.NoError(t, decoded.open(consumer, true, 0), id+" "+codec.Name())
+		}
+
+		m.Header["project"] = "baz"
+		assert.True(t, errors.Is(m.verify(consumer, true), ErrInvalidSignature), id)
+	}
+
+	m, _ := newMessage("foo")
+	assert.NoError(t, m.verify(consumer, false))
+	assert.True(t, errors.Is(m.verify(consumer, true), ErrInvalidSignature))
+	assert.Error(t, m.sign(consumer, "ed25519"))
+}
+
+func TestSubscribersShouldReceiveEncryptedAndSignedMessages(t *testing.T) {
+	s, c, closeFunc := newTestServer(t, "/TestCrypto")
+	defer closeFunc()
+	public, private, _ := ed25519.GenerateKey(nil)
+	secret := bytes.Repeat([]byte{1}, 32)
+	assert.NoError(t, s.Keyring.Add(Key{ID: "box", Algorithm: AlgorithmSecretbox, Secret: secret}))
+	assert.NoError(t, s.Keyring.Add(Key{ID: "server", Algorithm: AlgorithmEd25519, Secret: private}))
+	topic := s.CreateTopic("topic")
+	topic.mutex.Lock()
+	topic.Options = &Options{Encryption: "box", Signature: "server"}
+	topic.mutex.Unlock()
+
+	c.Keyring, _ = NewKeyring(
+		Key{ID: "box", Algorithm: AlgorithmSecretbox, Secret: secret},
+		Key{ID: "server", Algorithm: AlgorithmEd25519, Secret: public},
+	)
+	c.RequireSignature = true
+	sub, err := c.SubscribeContext(context.Background(), "topic")
+	assert.NoError(t, err)
+	waitForConnections(t, topic, 1)
+
+	assert.NoError(t, Publish(topic, testPayload{Name: "foo", Count: 2}))
+	select {
+	case m := <-sub.Messages:
+		p, err := Decode[testPayload](m)
+		assert.NoError(t, err)
+		assert.Equal(t, testPayload{Name: "foo", Count: 2}, p)
+	case err := <-sub.Errors:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Message not received")
+	}
+
+	topic.mutex.Lock()
+	topic.Options = &Options{}
+	topic.mutex.Unlock()
+	assert.NoError(t, topic.Publish("unsigned"))
+	select {
+	case m := <-sub.Messages:
+		t.Fatalf("Unsigned message %s should be rejected", m.Text())
+	case err := <-sub.Errors:
+		assert.True(t, errors.Is(err, ErrInvalidSignature))
+	case <-time.After(5 * time.Second):
+		t.Fatal("Error not received")
+	}
+}
@@ -0,0 +1,93 @@
+package wsqueue
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+//HeaderDedupID is the header holding the idempotency key of a message. If it is
+//missing, the ID of the message is used. See Options.DedupWindow
+const HeaderDedupID = "dedup-id"
+
+//defaultDedupSize is the default max number of keys kept by a dedup cache
+const defaultDedupSize = 10000
+
+//DedupStorage is implemented by the storage drivers which persist idempotency keys.
+//When the storage of a queue implements it, it is used instead of the in-memory cache
+type DedupStorage interface {
+	//Seen records key and returns true if it has already been recorded within window
+	Seen(key string, window time.Duration) bool
+}
+
+//dedupKey returns the idempotency key of m
+func dedupKey(m *Message) string {
+	if k := m.Header[HeaderDedupID]; k != "" {
+		return k
+	}
+	return m.ID()
+}
+
+//dedupEntry is an idempotency key and its date of reception
+type dedupEntry struct {
+	key  string
+	seen time.Time
+}
+
+//dedupCache is a LRU cache of idempotency keys with a TTL
+type dedupCache struct {
+	mutex   *sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+func newDedupCache() *dedupCache {
+	return &dedupCache{
+		mutex:   &sync.Mutex{},
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+//seen records key and returns true if it has already been recorded within window.
+//A repeat extends the window of the key. The cache keeps at most size keys, the
+//least recently seen are evicted first
+func (d *dedupCache) seen(key string, window time.Duration, size int) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	now := time.Now()
+
+	//Expired keys are at the back of the list
+	for e := d.order.Back(); e != nil && now.Sub(e.Value.(*dedupEntry).seen) > window; e = d.order.Back() {
+		d.order.Remove(e)
+		delete(d.entries, e.Value.(*dedupEntry).key)
+	}
+
+	if e, ok := d.entries[key]; ok {
+		e.Value.(*dedupEntry).seen = now
+		d.order.MoveToFront(e)
+		return true
+	}
+	d.entries[key] = d.order.PushFront(&dedupEntry{key: key, seen: now})
+	for d.order.Len() > size {
+		e := d.order.Back()
+		d.order.Remove(e)
+		delete(d.entries, e.Value.(*dedupEntry).key)
+	}
+	return false
+}
+
+//duplicate checks if m has already been sent on the destination within the dedup window of the options
+func (o *Options) duplicate(m *Message, cache *dedupCache, store StorageDriver) bool {
+	if o == nil || o.DedupWindow <= 0 {
+		return false
+	}
+	if s, ok := store.(DedupStorage); ok {
+		return s.Seen(dedupKey(m), o.DedupWindow)
+	}
+	size := o.DedupSize
+	if size <= 0 {
+		size = defaultDedupSize
+	}
+	return cache.seen(dedupKey(m), o.DedupWindow, size)
+}
@@ -0,0 +1,63 @@
+package wsqueue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedupCacheShouldExpireAndEvictKeys(t *testing.T) {
+	d := newDedupCache()
+	assert.False(t, d.seen("a", time.Minute, 2))
+	assert.True(t, d.seen("a", time.Minute, 2))
+	assert.False(t, d.seen("b", time.Minute, 2))
+	assert.True(t, d.seen("a", time.Minute, 2))
+	//b is the least recently seen key
+	assert.False(t, d.seen("c", time.Minute, 2))
+	assert.False(t, d.seen("b", time.Minute, 2))
+	assert.Equal(t, 2, d.order.Len())
+
+	assert.False(t, d.seen("d", 10*time.Millisecond, 2))
+	time.Sleep(20 * time.Millisecond)
+	assert.False(t, d.seen("d", 10*time.Millisecond, 2))
+	assert.Equal(t, 1, d.order.Len())
+}
+
+func TestQueueShouldDropDuplicateMessages(t *testing.T) {
+	s, c, closeFunc := newTestServer(t, "/TestDedup")
+	defer closeFunc()
+	q := s.CreateQueue("queue", 10)
+	q.mutex.Lock()
+	q.Options.DedupWindow = time.Minute
+	q.mutex.Unlock()
+
+	m, _ := NewMessage("foo")
+	assert.NoError(t, q.SendMessage(m))
+	retry, _ := NewMessage("foo")
+	retry.System.ID = m.ID()
+	assert.NoError(t, q.SendMessage(retry))
+	assert.NoError(t, q.SendWithHeaders("bar", Header{HeaderDedupID: "job-1"}))
+	assert.NoError(t, q.SendWithHeaders("bar", Header{HeaderDedupID: "job-1"}))
+	assert.NoError(t, q.Send("baz"))
+
+	sub, err := c.ListenContext(context.Background(), "queue")
+	assert.NoError(t, err)
+	received := []string{}
+	for i := 0; i < 3; i++ {
+		select {
+		case m := <-sub.Messages:
+			received = append(received, m.Text())
+			assert.NoError(t, c.Ack(&m))
+		case <-time.After(5 * time.Second):
+			t.Fatal("Message not received")
+		}
+	}
+	assert.ElementsMatch(t, []string{"foo", "bar", "baz"}, received)
+	select {
+	case m := <-sub.Messages:
+		t.Fatalf("Duplicate message %s received", m.Text())
+	case <-time.After(300 * time.Millisecond):
+	}
+}
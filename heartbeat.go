@@ -0,0 +1,76 @@
+package wsqueue
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+//heartbeat pings a connection periodically. The connection is considered dead if
+//neither a pong nor a frame is read within the pong timeout: its next read fails
+type heartbeat struct {
+	conn    *websocket.Conn
+	timeout time.Duration
+	stop    chan struct{}
+	once    *sync.Once
+}
+
+//startHeartbeat pings conn every interval. If timeout is 0, it is twice the interval.
+//It returns nil if interval is 0
+func startHeartbeat(conn *websocket.Conn, interval, timeout time.Duration) *heartbeat {
+	if interval <= 0 {
+		return nil
+	}
+	if timeout <= 0 {
+		timeout = 2 * interval
+	}
+	h := &heartbeat{
+		conn:    conn,
+		timeout: timeout,
+		stop:    make(chan struct{}),
+		once:    &sync.Once{},
+	}
+	h.alive()
+	conn.SetPongHandler(func(string) error {
+		h.alive()
+		return nil
+	})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(interval)); err != nil {
+					return
+				}
+			case <-h.stop:
+				return
+			}
+		}
+	}()
+	return h
+}
+
+//alive extends the read deadline of the connection. It must be called by the reader of the connection
+func (h *heartbeat) alive() {
+	if h != nil {
+		h.conn.SetReadDeadline(time.Now().Add(h.timeout))
+	}
+}
+
+//Stop stops the pings
+func (h *heartbeat) Stop() {
+	if h != nil {
+		h.once.Do(func() { close(h.stop) })
+	}
+}
+
+//isTimeout checks if a read failed because the connection was idle
+func isTimeout(err error) bool {
+	var e net.Error
+	return errors.As(err, &e) && e.Timeout()
+}
@@ -0,0 +1,88 @@
+package wsqueue
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerShouldEvictIdleConnections(t *testing.T) {
+	s, c, closeFunc := newTestServer(t, "/TestHeartbeat")
+	defer closeFunc()
+	s.PingInterval = 20 * time.Millisecond
+	s.PongTimeout = 100 * time.Millisecond
+	topic := s.CreateTopic("topic")
+	var closed int32
+	topic.ClosedConnectionHandler = func(*Conn) { atomic.AddInt32(&closed, 1) }
+
+	//The client reads, and so answers to pings
+	sub, err := c.SubscribeContext(context.Background(), "topic")
+	assert.NoError(t, err)
+	waitForConnections(t, topic, 1)
+
+	//A half-open connection never answers to pings
+	idle := s.IdleConnectionsCounter.Value()
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+c.Host+c.Route+"wsqueue/topic/topic", nil)
+	assert.NoError(t, err)
+	defer conn.Close()
+	waitForConnections(t, topic, 2)
+	waitForConnections(t, topic, 1)
+	for i := 0; i < 100 && atomic.LoadInt32(&closed) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&closed))
+	assert.Equal(t, idle+1, s.IdleConnectionsCounter.Value())
+
+	assert.NoError(t, topic.Publish("foo"))
+	select {
+	case m := <-sub.Messages:
+		assert.Equal(t, "foo", m.Text())
+	case <-time.After(5 * time.Second):
+		t.Fatal("Message not received")
+	}
+}
+
+func TestClientShouldReconnectIdleConnections(t *testing.T) {
+	var connections int32
+	upgrader := websocket.Upgrader{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		atomic.AddInt32(&connections, 1)
+		//The server never reads, and so never answers to pings
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	c := &Client{
+		Protocol:        "ws",
+		Host:            strings.TrimPrefix(ts.URL, "http://"),
+		Route:           "/",
+		PingInterval:    20 * time.Millisecond,
+		PongTimeout:     100 * time.Millisecond,
+		ReconnectPolicy: &ReconnectPolicy{MaxRetries: -1, TimeUnit: time.Millisecond},
+	}
+	defer c.Close()
+	sub, err := c.SubscribeContext(context.Background(), "topic")
+	assert.NoError(t, err)
+	select {
+	case err := <-sub.Errors:
+		assert.True(t, isTimeout(err))
+	case <-time.After(5 * time.Second):
+		t.Fatal("Idle connection not detected")
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(&connections) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, atomic.LoadInt32(&connections) >= 2)
+}
@@ -0,0 +1,221 @@
+package wsqueue
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+//LoadBalancer chooses the consumer of each message sent to a Queue. Its methods
+//are called with the queue locked
+type LoadBalancer interface {
+	//Add is called when a consumer joins the queue
+	Add(c *Conn)
+	//Remove is called when a consumer exits the queue
+	Remove(c *Conn)
+	//Next returns the consumer of m among consumers, which all have free credits, sorted by ID.
+	//If it returns nil, the message is kept until a consumer is available
+	Next(m *Message, consumers []*Conn) *Conn
+}
+
+//KeyedLoadBalancer is implemented by the LoadBalancers which send some messages to a
+//given consumer, such as ConsistentHash. The messages waiting for credits of their
+//consumer are kept aside in FIFO order, so that other messages are still dispatched
+type KeyedLoadBalancer interface {
+	LoadBalancer
+	//Owner returns the consumer of m, if m must be sent to a given consumer
+	Owner(m *Message) (ConnID, bool)
+}
+
+//RoundRobin sends messages to each consumer in turn
+type RoundRobin struct {
+	last ConnID
+}
+
+//NewRoundRobin returns a round-robin LoadBalancer. This is the default LoadBalancer of queues
+func NewRoundRobin() *RoundRobin {
+	return &RoundRobin{}
+}
+
+//Add does nothing
+func (lb *RoundRobin) Add(c *Conn) {}
+
+//Remove does nothing
+func (lb *RoundRobin) Remove(c *Conn) {}
+
+//Next returns the consumer following the last chosen one
+func (lb *RoundRobin) Next(m *Message, consumers []*Conn) *Conn {
+	if len(consumers) == 0 {
+		return nil
+	}
+	next := consumers[0]
+	for _, c := range consumers {
+		if c.ID > lb.last {
+			next = c
+			break
+		}
+	}
+	lb.last = next.ID
+	return next
+}
+
+//LeastInFlight sends messages to the consumer with the fewest unacknowledged messages
+type LeastInFlight struct{}
+
+//NewLeastInFlight returns a least-in-flight LoadBalancer
+func NewLeastInFlight() *LeastInFlight {
+	return &LeastInFlight{}
+}
+
+//Add does nothing
+func (lb *LeastInFlight) Add(c *Conn) {}
+
+//Remove does nothing
+func (lb *LeastInFlight) Remove(c *Conn) {}
+
+//Next returns the consumer with the fewest unacknowledged messages
+func (lb *LeastInFlight) Next(m *Message, consumers []*Conn) *Conn {
+	var next *Conn
+	for _, c := range consumers {
+		if next == nil || c.InFlight() < next.InFlight() {
+			next = c
+		}
+	}
+	return next
+}
+
+//Weighted sends messages to consumers in proportion to the weight they passed
+//on Listen (smooth weighted round-robin). Default weight is 1
+type Weighted struct {
+	current map[ConnID]int
+}
+
+//NewWeighted returns a weighted LoadBalancer
+func NewWeighted() *Weighted {
+	return &Weighted{current: make(map[ConnID]int)}
+}
+
+//Add registers the consumer
+func (lb *Weighted) Add(c *Conn) {
+	lb.current[c.ID] = 0
+}
+
+//Remove unregisters the consumer
+func (lb *Weighted) Remove(c *Conn) {
+	delete(lb.current, c.ID)
+}
+
+//Next returns the consumer with the highest current weight
+func (lb *Weighted) Next(m *Message, consumers []*Conn) *Conn {
+	var next *Conn
+	total := 0
+	for _, c := range consumers {
+		w := c.Weight
+		if w < 1 {
+			w = 1
+		}
+		total += w
+		lb.current[c.ID] += w
+		if next == nil || lb.current[c.ID] > lb.current[next.ID] {
+			next = c
+		}
+	}
+	if next != nil {
+		lb.current[next.ID] -= total
+	}
+	return next
+}
+
+//ConsistentHash sends all messages with the same value of a header to the same
+//consumer. Messages without this header are sent in round-robin. When a consumer
+//exits, only its keys are moved to other consumers
+type ConsistentHash struct {
+	header     string
+	replicas   int
+	ring       []uint32
+	owners     map[uint32]ConnID
+	roundRobin *RoundRobin
+}
+
+//NewConsistentHash returns a consistent-hash LoadBalancer on header
+func NewConsistentHash(header string) *ConsistentHash {
+	return &ConsistentHash{
+		header:     header,
+		replicas:   100,
+		owners:     make(map[uint32]ConnID),
+		roundRobin: NewRoundRobin(),
+	}
+}
+
+func hash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+//Add places the consumer on the ring
+func (lb *ConsistentHash) Add(c *Conn) {
+	for i := 0; i < lb.replicas; i++ {
+		h := hash(string(c.ID) + "#" + strconv.Itoa(i))
+		if _, ok := lb.owners[h]; ok {
+			continue
+		}
+		lb.owners[h] = c.ID
+		lb.ring = append(lb.ring, h)
+	}
+	sort.Slice(lb.ring, func(i, j int) bool { return lb.ring[i] < lb.ring[j] })
+}
+
+//Remove removes the consumer from the ring
+func (lb *ConsistentHash) Remove(c *Conn) {
+	ring := lb.ring[:0]
+	for _, h := range lb.ring {
+		if lb.owners[h] == c.ID {
+			delete(lb.owners, h)
+			continue
+		}
+		ring = append(ring, h)
+	}
+	lb.ring = ring
+}
+
+//owner returns the consumer owning key on the ring
+func (lb *ConsistentHash) owner(key string) (ConnID, bool) {
+	if len(lb.ring) == 0 {
+		return "", false
+	}
+	h := hash(key)
+	i := sort.Search(len(lb.ring), func(i int) bool { return lb.ring[i] >= h })
+	if i == len(lb.ring) {
+		i = 0
+	}
+	return lb.owners[lb.ring[i]], true
+}
+
+//Owner returns the owner of the header value, if the message has this header
+func (lb *ConsistentHash) Owner(m *Message) (ConnID, bool) {
+	key := m.Header[lb.header]
+	if key == "" {
+		return "", false
+	}
+	return lb.owner(key)
+}
+
+//Next returns the owner of the header value. If the owner has no free credits, it
+//returns nil so that the message waits for it
+func (lb *ConsistentHash) Next(m *Message, consumers []*Conn) *Conn {
+	key := m.Header[lb.header]
+	if key == "" {
+		return lb.roundRobin.Next(m, consumers)
+	}
+	id, ok := lb.owner(key)
+	if !ok {
+		return nil
+	}
+	for _, c := range consumers {
+		if c.ID == id {
+			return c
+		}
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package wsqueue
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoundRobin(t *testing.T) {
+	a, b, c := &Conn{ID: "a"}, &Conn{ID: "b"}, &Conn{ID: "c"}
+	lb := NewRoundRobin()
+	m := &Message{Header: Header{}}
+	assert.Equal(t, a, lb.Next(m, []*Conn{a, b, c}))
+	assert.Equal(t, b, lb.Next(m, []*Conn{a, b, c}))
+	assert.Equal(t, c, lb.Next(m, []*Conn{a, b, c}))
+	assert.Equal(t, a, lb.Next(m, []*Conn{a, b, c}))
+	assert.Equal(t, c, lb.Next(m, []*Conn{a, c}))
+	assert.Nil(t, lb.Next(m, nil))
+}
+
+func TestLeastInFlight(t *testing.T) {
+	a, b := &Conn{ID: "a", inflight: 3}, &Conn{ID: "b", inflight: 1}
+	lb := NewLeastInFlight()
+	assert.Equal(t, b, lb.Next(&Message{}, []*Conn{a, b}))
+}
+
+func TestWeighted(t *testing.T) {
+	a, b := &Conn{ID: "a", Weight: 3}, &Conn{ID: "b"}
+	lb := NewWeighted()
+	lb.Add(a)
+	lb.Add(b)
+	counts := map[ConnID]int{}
+	for i := 0; i < 8; i++ {
+		counts[lb.Next(&Message{}, []*Conn{a, b}).ID]++
+	}
+	assert.Equal(t, map[ConnID]int{"a": 6, "b": 2}, counts)
+}
+
+func TestConsistentHash(t *testing.T) {
+	conns := []*Conn{{ID: "a"}, {ID: "b"}, {ID: "c"}}
+	lb := NewConsistentHash("project")
+	for _, c := range conns {
+		lb.Add(c)
+	}
+
+	owners := map[string]*Conn{}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("project-%d", i)
+		m := &Message{Header: Header{"project": key}}
+		owners[key] = lb.Next(m, conns)
+		assert.Equal(t, owners[key], lb.Next(m, conns), "same key should go to the same consumer")
+	}
+
+	lb.Remove(conns[2])
+	for key, owner := range owners {
+		m := &Message{Header: Header{"project": key}}
+		next := lb.Next(m, conns[:2])
+		if owner != conns[2] {
+			assert.Equal(t, owner, next, "keys of remaining consumers should not move")
+		} else {
+			assert.NotNil(t, next)
+		}
+	}
+
+	m := &Message{Header: Header{"project": "project-0"}}
+	assert.Nil(t, lb.Next(m, []*Conn{}), "message should wait for its owner")
+}
+
+func TestQueueShouldHoldMessagesForBusyOwners(t *testing.T) {
+	s, c, closeFunc := newTestServer(t, "/TestHeldMessages")
+	defer closeFunc()
+	q := s.CreateQueue("queue", 100)
+	lb := NewConsistentHash("project")
+	q.SetLoadBalancer(lb)
+
+	subs := []*Subscription{}
+	for i := 0; i < 2; i++ {
+		sub, err := c.ListenWithOptions(context.Background(), "queue", &ListenOptions{Prefetch: 1})
+		assert.NoError(t, err)
+		subs = append(subs, sub)
+	}
+	waitForConsumers(t, q, 2)
+
+	//Find a key owned by each consumer
+	keys := map[ConnID]string{}
+	q.mutex.RLock()
+	for i := 0; len(keys) < 2; i++ {
+		key := fmt.Sprintf("project-%d", i)
+		if id, _ := lb.owner(key); keys[id] == "" {
+			keys[id] = key
+		}
+	}
+	q.mutex.RUnlock()
+	var x, y ConnID
+	for id := range keys {
+		if x == "" {
+			x = id
+		} else {
+			y = id
+		}
+	}
+
+	receive := func(subs ...*Subscription) (Message, *Subscription) {
+		cases := []reflect.SelectCase{{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(time.After(5 * time.Second))}}
+		for _, sub := range subs {
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(sub.Messages)})
+		}
+		i, v, _ := reflect.Select(cases)
+		if i == 0 {
+			t.Fatal("Message not received")
+		}
+		return v.Interface().(Message), subs[i-1]
+	}
+
+	assert.NoError(t, q.SendWithHeaders("x1", Header{"project": keys[x]}))
+	x1, subX := receive(subs...)
+	assert.Equal(t, "x1", x1.Text())
+	subY := subs[0]
+	if subY == subX {
+		subY = subs[1]
+	}
+
+	//The owner of x has no credits: its messages are held, the others are still dispatched
+	assert.NoError(t, q.SendWithHeaders("x2", Header{"project": keys[x]}))
+	assert.NoError(t, q.SendWithHeaders("x3", Header{"project": keys[x]}))
+	assert.NoError(t, q.SendWithHeaders("y1", Header{"project": keys[y]}))
+	y1, _ := receive(subY)
+	assert.Equal(t, "y1", y1.Text())
+	q.mutex.RLock()
+	assert.Len(t, q.held[x], 2)
+	q.mutex.RUnlock()
+	assert.Equal(t, 0, q.store.(*Stack).Len())
+
+	m := x1
+	for _, expected := range []string{"x2", "x3"} {
+		assert.NoError(t, c.Ack(&m))
+		m, _ = receive(subX)
+		assert.Equal(t, expected, m.Text())
+	}
+}
+
+//bodyHash is a consistent-hash LoadBalancer on the body of the messages
+type bodyHash struct {
+	*ConsistentHash
+}
+
+func (lb bodyHash) Owner(m *Message) (ConnID, bool) {
+	return lb.owner(m.Body)
+}
+
+func (lb bodyHash) Next(m *Message, consumers []*Conn) *Conn {
+	id, _ := lb.owner(m.Body)
+	for _, c := range consumers {
+		if c.ID == id {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestSendBatchShouldHoldMessagesForBusyOwners(t *testing.T) {
+	s, c, closeFunc := newTestServer(t, "/TestHeldBatches")
+	defer closeFunc()
+	q := s.CreateQueue("queue", 100)
+	lb := bodyHash{NewConsistentHash("")}
+	q.SetLoadBalancer(lb)
+
+	subs := map[ConnID]*Subscription{}
+	for i := 0; i < 2; i++ {
+		sub, err := c.ListenWithOptions(context.Background(), "queue", &ListenOptions{Prefetch: 1})
+		assert.NoError(t, err)
+		waitForConsumers(t, q, i+1)
+		q.mutex.RLock()
+		for id := range q.wsConnections {
+			if _, ok := subs[id]; !ok {
+				subs[id] = sub
+			}
+		}
+		q.mutex.RUnlock()
+	}
+
+	keys := map[ConnID]string{}
+	q.mutex.RLock()
+	for i := 0; len(keys) < 2; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if id, _ := lb.owner(key); keys[id] == "" {
+			keys[id] = key
+		}
+	}
+	q.mutex.RUnlock()
+	var x, y ConnID
+	for id := range keys {
+		if x == "" {
+			x = id
+		} else {
+			y = id
+		}
+	}
+
+	receive := func(sub *Subscription) *Message {
+		select {
+		case m := <-sub.Messages:
+			return &m
+		case <-time.After(5 * time.Second):
+			t.Fatal("Message not received")
+		}
+		return nil
+	}
+
+	assert.NoError(t, q.Send(keys[x]))
+	m := receive(subs[x])
+
+	//The message of the busy owner is held, the other one is still dispatched
+	assert.NoError(t, q.SendBatch(keys[x], keys[y]))
+	assert.Equal(t, keys[y], receive(subs[y]).Text())
+	q.mutex.RLock()
+	assert.Len(t, q.held[x], 1)
+	q.mutex.RUnlock()
+	assert.Equal(t, 0, q.store.(*Stack).Len())
+
+	//A new message waits behind the held ones, even if its owner has credits again
+	other := ""
+	for i := 0; other == ""; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if id, _ := lb.owner(key); id == x && key != keys[x] {
+			other = key
+		}
+	}
+	q.mutex.Lock()
+	q.untrack(q.wsConnections[x], m)
+	q.mutex.Unlock()
+	assert.NoError(t, q.SendBatch(other))
+	m = receive(subs[x])
+	assert.Equal(t, keys[x], m.Text())
+	assert.NoError(t, c.Ack(m))
+	assert.Equal(t, other, receive(subs[x]).Text())
+}
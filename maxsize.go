@@ -0,0 +1,93 @@
+package wsqueue
+
+import (
+	"fmt"
+	"net/http"
+)
+
+//ContentTypeError is the content-type of the frames sent by the server when it rejects
+//a message. Their body is a JSON ErrorResponse
+const ContentTypeError = "application/x-wsqueue-error"
+
+//keys returns the keyring of the server
+func (s *Server) keys() *Keyring {
+	if s == nil {
+		return nil
+	}
+	return s.Keyring
+}
+
+//maxMessageSize returns the max body size of the messages of a destination. The options
+//of the destination take precedence over the server settings
+func (s *Server) maxMessageSize(o *Options) int {
+	if o != nil && o.MaxMessageSize > 0 {
+		return o.MaxMessageSize
+	}
+	if s == nil {
+		return 0
+	}
+	return s.MaxMessageSize
+}
+
+//maxFrameSize returns the max frame size of the connections to a destination. The options
+//of the destination take precedence over the server settings
+func (s *Server) maxFrameSize(o *Options) int64 {
+	if o != nil && o.MaxFrameSize > 0 {
+		return o.MaxFrameSize
+	}
+	if s == nil {
+		return 0
+	}
+	return s.MaxFrameSize
+}
+
+//oversized counts a message rejected because of its size
+func (s *Server) oversized() {
+	if s != nil && s.OversizedMessagesCounter != nil {
+		s.OversizedMessagesCounter.Add(1)
+	}
+}
+
+//Error returns the reason of the error
+func (e *ErrorResponse) Error() string {
+	if e.Destination == "" {
+		return fmt.Sprintf("%d %s", e.Code, e.Reason)
+	}
+	return fmt.Sprintf("%d %s : %s", e.Code, e.Reason, e.Destination)
+}
+
+//Unwrap returns the wsqueue error matching the code of the response, if any
+func (e *ErrorResponse) Unwrap() error {
+	switch e.Code {
+	case http.StatusRequestEntityTooLarge:
+		return ErrMessageTooLarge
+	case http.StatusForbidden:
+		return ErrForbidden
+	}
+	return nil
+}
+
+//newErrorMessage returns an error frame about the message id
+func newErrorMessage(code int, reason string, destination string, id string) (*Message, error) {
+	m, err := newMessage(&ErrorResponse{Code: code, Reason: reason, Destination: destination})
+	if err != nil {
+		return nil, err
+	}
+	m.System.ContentType = ContentTypeError
+	m.System.CorrelationID = id
+	return m, nil
+}
+
+//IsError returns true if the message is an error frame sent by the server
+func (m *Message) IsError() bool {
+	return m.ContentType() == ContentTypeError
+}
+
+//errorResponse decodes an error frame
+func (m *Message) errorResponse() error {
+	e := &ErrorResponse{}
+	if err := JSONCodec.Unmarshal([]byte(m.Body), e); err != nil {
+		return err
+	}
+	return e
+}
@@ -0,0 +1,111 @@
+package wsqueue
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProducersShouldNotSendTooLargeMessages(t *testing.T) {
+	s, _, closeFunc := newTestServer(t, "/TestMaxSize")
+	defer closeFunc()
+	s.MaxMessageSize = 10
+	q := s.CreateQueue("queue", 10)
+	topic := s.CreateTopic("topic")
+	topic.mutex.Lock()
+	topic.Options = &Options{MaxMessageSize: 100}
+	topic.mutex.Unlock()
+
+	oversized := s.OversizedMessagesCounter.Value()
+	assert.NoError(t, q.Send("small"))
+	assert.True(t, errors.Is(q.Send(strings.Repeat("a", 11)), ErrMessageTooLarge))
+	assert.True(t, errors.Is(q.SendBatch("small", strings.Repeat("a", 11)), ErrMessageTooLarge))
+	assert.NoError(t, topic.Publish(strings.Repeat("a", 100)))
+	assert.True(t, errors.Is(topic.Publish(strings.Repeat("a", 101)), ErrMessageTooLarge))
+	assert.Equal(t, oversized+3, s.OversizedMessagesCounter.Value())
+}
+
+func TestServerShouldRejectTooLargeMessagesFromClients(t *testing.T) {
+	s, c, closeFunc := newTestServer(t, "/TestMaxSizeClient")
+	defer closeFunc()
+	s.MaxMessageSize = 10
+	q := s.CreateQueue("queue", 10)
+	sub, err := c.ListenContext(context.Background(), "queue")
+	assert.NoError(t, err)
+	waitForConsumers(t, q, 1)
+
+	oversized := s.OversizedMessagesCounter.Value()
+	m, _ := newMessage(strings.Repeat("a", 11))
+	assert.NoError(t, sub.write(m))
+	select {
+	case err := <-sub.Errors:
+		assert.True(t, errors.Is(err, ErrMessageTooLarge))
+		var response *ErrorResponse
+		assert.True(t, errors.As(err, &response))
+		assert.Equal(t, "queue", response.Destination)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Error frame not received")
+	}
+	assert.Equal(t, oversized+1, s.OversizedMessagesCounter.Value())
+}
+
+func TestCompressedMessagesShouldBeLimitedOnceDecompressed(t *testing.T) {
+	s, c, closeFunc := newTestServer(t, "/TestMaxSizeCompressed")
+	defer closeFunc()
+	s.MaxMessageSize = 1024
+	q := s.CreateQueue("queue", 10)
+	q.mutex.Lock()
+	q.Options.ContentEncoding = EncodingGzip
+	q.mutex.Unlock()
+	c.MaxMessageSize = 100
+	sub, err := c.ListenContext(context.Background(), "queue")
+	assert.NoError(t, err)
+	waitForConsumers(t, q, 1)
+
+	//The server limits the messages of the clients once decompressed
+	oversized := s.OversizedMessagesCounter.Value()
+	m, _ := newMessage(strings.Repeat("a", 1<<20))
+	assert.NoError(t, m.compress(EncodingGzip))
+	assert.NoError(t, sub.write(m))
+	select {
+	case err := <-sub.Errors:
+		var response *ErrorResponse
+		assert.True(t, errors.As(err, &response))
+		assert.Equal(t, 413, response.Code)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Error frame not received")
+	}
+	assert.Equal(t, oversized+1, s.OversizedMessagesCounter.Value())
+
+	//The client limits the messages of the server once decompressed
+	assert.NoError(t, q.Send(strings.Repeat("a", 1000)))
+	select {
+	case err := <-sub.Errors:
+		assert.True(t, errors.Is(err, ErrMessageTooLarge))
+	case m := <-sub.Messages:
+		t.Fatalf("Message of %d bytes should be rejected", len(m.Text()))
+	case <-time.After(5 * time.Second):
+		t.Fatal("Error not received")
+	}
+}
+
+func TestServerShouldCloseConnectionsSendingTooLargeFrames(t *testing.T) {
+	s, c, closeFunc := newTestServer(t, "/TestMaxFrameSize")
+	defer closeFunc()
+	s.MaxFrameSize = 512
+	topic := s.CreateTopic("topic")
+	c.ReconnectPolicy = &ReconnectPolicy{MaxRetries: 0}
+	sub, err := c.SubscribeContext(context.Background(), "topic")
+	assert.NoError(t, err)
+	waitForConnections(t, topic, 1)
+
+	oversized := s.OversizedMessagesCounter.Value()
+	m, _ := newMessage(strings.Repeat("a", 1024))
+	assert.NoError(t, sub.write(m))
+	waitForConnections(t, topic, 0)
+	assert.Equal(t, oversized+1, s.OversizedMessagesCounter.Value())
+}
@@ -2,20 +2,107 @@ package wsqueue
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"reflect"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/satori/go.uuid"
 )
 
+//Header is the user metadata of a message. Keys starting with HeaderReservedPrefix
+//are reserved to wsqueue
 type Header map[string]string
 
-//Message message
+//HeaderReservedPrefix is the prefix of the header keys reserved to wsqueue
+const HeaderReservedPrefix = "wsqueue-"
+
+//ErrReservedHeader is returned when a producer sets a header in the reserved namespace
+var ErrReservedHeader = errors.New("Header key is reserved")
+
+//Int returns the value of key as an int
+func (h Header) Int(key string) (int, error) {
+	return strconv.Atoi(h[key])
+}
+
+//SetInt sets the value of key to an int
+func (h Header) SetInt(key string, i int) {
+	h[key] = strconv.Itoa(i)
+}
+
+//Time returns the value of key as a time, formatted in RFC3339Nano
+func (h Header) Time(key string) (time.Time, error) {
+	return time.Parse(time.RFC3339Nano, h[key])
+}
+
+//SetTime sets the value of key to a time, formatted in RFC3339Nano
+func (h Header) SetTime(key string, t time.Time) {
+	h[key] = t.Format(time.RFC3339Nano)
+}
+
+//validate checks that no key is in the reserved namespace
+func (h Header) validate() error {
+	for k := range h {
+		if strings.HasPrefix(k, HeaderReservedPrefix) {
+			return fmt.Errorf("%s: %w", k, ErrReservedHeader)
+		}
+	}
+	return nil
+}
+
+//SystemHeader is the metadata of a message managed by wsqueue
+type SystemHeader struct {
+	ID string `json:"id"`
+	//Timestamp is the date of creation of the message
+	Timestamp time.Time `json:"timestamp"`
+	//Host is the hostname of the producer
+	Host string `json:"host,omitempty"`
+	//CorrelationID links a message to another one, for instance a reply to a request
+	CorrelationID string `json:"correlation_id,omitempty"`
+	//TTL is the lifetime of the message. Expired messages are dropped by queues. 0 means no limit
+	TTL             time.Duration `json:"ttl,omitempty"`
+	ContentType     string        `json:"content_type,omitempty"`
+	ApplicationType string        `json:"application_type,omitempty"`
+	ContentEncoding string        `json:"content_encoding,omitempty"`
+	//EncryptionKey is the ID of the key used to encrypt the payload
+	EncryptionKey string `json:"encryption_key,omitempty"`
+	//SignatureKey is the ID of the key used to sign the message
+	SignatureKey string `json:"signature_key,omitempty"`
+	Signature    []byte `json:"signature,omitempty"`
+	//ChunkIndex, ChunkCount and ChunkTotal describe the part of a large message held by a chunk, see ContentTypeChunk
+	ChunkIndex int `json:"chunk_index,omitempty"`
+	ChunkCount int `json:"chunk_count,omitempty"`
+	ChunkTotal int `json:"chunk_total,omitempty"`
+	//Ack is set by consumers on ack messages, with the ID of the acknowledged message
+	Ack string `json:"ack,omitempty"`
+	//Nack is set by consumers on nack messages, with the ID of the rejected message
+	Nack string `json:"nack,omitempty"`
+	//Received is the date of reception of the message by the client
+	Received time.Time `json:"-"`
+}
+
+//Message message. Text payloads are sent in Body, binary payloads in Raw: Raw is
+//sent as is by binary codecs and encoded in base64 by JSONCodec
 type Message struct {
-	Header Header `json:"metadata,omitempty"`
-	Body   string `json:"data"`
+	System SystemHeader `json:"system"`
+	Header Header       `json:"metadata,omitempty"`
+	Body   string       `json:"data"`
+	Raw    []byte       `json:"raw,omitempty"`
+	//Batch holds the messages of a batch frame, see ContentTypeBatch
+	Batch        []Message `json:"batch,omitempty"`
+	subscription *Subscription
+}
+
+//ContentTypeBinary is the default content-type of binary payloads
+const ContentTypeBinary = "application/octet-stream"
+
+//NewMessage returns a new message with system headers set. Its user headers and its
+//CorrelationID and TTL may be set before it is sent with Queue.SendMessage or Topic.PublishMessage
+func NewMessage(data interface{}) (*Message, error) {
+	return newMessage(data)
 }
 
 func newMessage(data interface{}) (*Message, error) {
@@ -24,57 +111,212 @@ func newMessage(data interface{}) (*Message, error) {
 		Body:   "",
 	}
 
-	switch data.(type) {
-	case string, *string:
-		m.Header["content-type"] = "string"
-		m.Body = data.(string)
-	case int, *int, int32, *int32, int64, *int64:
-		m.Header["content-type"] = "int"
-		m.Body = strconv.Itoa(data.(int))
-	case bool, *bool:
-		m.Header["content-type"] = "bool"
-		m.Body = strconv.FormatBool(data.(bool))
+	v := reflect.ValueOf(data)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return nil, errors.New("Cannot send nil message")
+	}
+	m.System.ApplicationType = v.Type().String()
+
+	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+		m.System.ContentType = ContentTypeBinary
+		m.Raw = v.Bytes()
+		return m.stamp(), nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		m.System.ContentType = "string"
+		m.Body = v.String()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		m.System.ContentType = "int"
+		m.Body = strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		m.System.ContentType = "uint"
+		m.Body = strconv.FormatUint(v.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		m.System.ContentType = "float"
+		m.Body = strconv.FormatFloat(v.Float(), 'g', -1, v.Type().Bits())
+	case reflect.Bool:
+		m.System.ContentType = "bool"
+		m.Body = strconv.FormatBool(v.Bool())
 	default:
-		m.Header["content-type"] = "application/json"
-		if reflect.TypeOf(data).Kind() == reflect.Ptr {
-			m.Header["application-type"] = reflect.ValueOf(data).Elem().Type().String()
-		} else {
-			m.Header["application-type"] = reflect.ValueOf(data).Type().String()
-		}
+		m.System.ContentType = "application/json"
 		b, err := json.Marshal(data)
 		if err != nil {
 			return nil, err
 		}
 		m.Body = string(b)
 	}
-	m.Header["id"] = uuid.NewV1().String()
-	m.Header["date"] = time.Now().String()
-	m.Header["host"], _ = os.Hostname()
-	return &m, nil
+	return m.stamp(), nil
+}
+
+//newBinaryMessage returns a message with a binary payload and a MIME content-type
+func newBinaryMessage(contentType string, data []byte) *Message {
+	m := Message{
+		Header: Header{},
+		System: SystemHeader{ContentType: contentType},
+		Raw:    data,
+	}
+	if contentType == "" {
+		m.System.ContentType = ContentTypeBinary
+	}
+	return m.stamp()
+}
+
+//stamp sets the system headers of a new message
+func (m *Message) stamp() *Message {
+	m.System.ID = uuid.NewV1().String()
+	m.System.Timestamp = time.Now().UTC()
+	m.System.Host, _ = os.Hostname()
+	return m
+}
+
+//withHeaders adds user headers to m
+func (m *Message) withHeaders(h Header) (*Message, error) {
+	if err := h.validate(); err != nil {
+		return nil, err
+	}
+	for k, v := range h {
+		m.Header[k] = v
+	}
+	return m, nil
+}
+
+//check validates a message built by a producer and sets its missing system headers
+func (m *Message) check() error {
+	if m.Header == nil {
+		m.Header = Header{}
+	}
+	if err := m.Header.validate(); err != nil {
+		return err
+	}
+	if m.System.ID == "" {
+		m.stamp()
+	}
+	return nil
+}
+
+//Expired checks if the TTL of the message is over
+func (m *Message) Expired() bool {
+	return m.System.TTL > 0 && time.Since(m.System.Timestamp) > m.System.TTL
+}
+
+//isAck checks if m is an ack or a nack sent by a queue consumer, without payload
+func (m *Message) isAck() bool {
+	return (m.System.Ack != "" || m.System.Nack != "") && m.Body == "" && len(m.Raw) == 0
+}
+
+//decode decodes the body of m in v according to its content-type. v must be settable
+func (m *Message) decode(v reflect.Value) error {
+	if m.IsBinary() {
+		if v.Kind() != reflect.Slice || v.Type().Elem().Kind() != reflect.Uint8 {
+			return fmt.Errorf("Cannot decode binary payload in %s", v.Type().String())
+		}
+		v.SetBytes(m.Bytes())
+		return nil
+	}
+	if t := m.ApplicationType(); t != "" && t != v.Type().String() {
+		return fmt.Errorf("Cannot decode %s in %s", t, v.Type().String())
+	}
+	var err error
+	switch m.ContentType() {
+	case "string":
+		if v.Kind() != reflect.String {
+			return fmt.Errorf("Cannot decode string in %s", v.Type().String())
+		}
+		v.SetString(m.Body)
+	case "int":
+		var i int64
+		if i, err = strconv.ParseInt(m.Body, 10, 64); err == nil {
+			if v.Kind() < reflect.Int || v.Kind() > reflect.Int64 || v.OverflowInt(i) {
+				return fmt.Errorf("Cannot decode int %s in %s", m.Body, v.Type().String())
+			}
+			v.SetInt(i)
+		}
+	case "uint":
+		var u uint64
+		if u, err = strconv.ParseUint(m.Body, 10, 64); err == nil {
+			if v.Kind() < reflect.Uint || v.Kind() > reflect.Uint64 || v.OverflowUint(u) {
+				return fmt.Errorf("Cannot decode uint %s in %s", m.Body, v.Type().String())
+			}
+			v.SetUint(u)
+		}
+	case "float":
+		var f float64
+		if f, err = strconv.ParseFloat(m.Body, 64); err == nil {
+			if (v.Kind() != reflect.Float32 && v.Kind() != reflect.Float64) || v.OverflowFloat(f) {
+				return fmt.Errorf("Cannot decode float %s in %s", m.Body, v.Type().String())
+			}
+			v.SetFloat(f)
+		}
+	case "bool":
+		var b bool
+		if b, err = strconv.ParseBool(m.Body); err == nil {
+			if v.Kind() != reflect.Bool {
+				return fmt.Errorf("Cannot decode bool in %s", v.Type().String())
+			}
+			v.SetBool(b)
+		}
+	default:
+		err = json.Unmarshal([]byte(m.Body), v.Addr().Interface())
+	}
+	return err
 }
 
 func (m *Message) String() string {
 	var s string
 	s = "\n---HEADER---"
+	s = s + "\nid:" + m.System.ID
+	s = s + "\ntimestamp:" + m.System.Timestamp.Format(time.RFC3339Nano)
+	s = s + "\nhost:" + m.System.Host
+	s = s + "\ncontent-type:" + m.System.ContentType
 	for k, v := range m.Header {
 		s = s + "\n" + k + ":" + v
 	}
 	s = s + "\n---BODY---"
-	s = s + "\n" + m.Body
+	if m.IsBinary() {
+		s = s + "\n" + strconv.Itoa(len(m.Raw)) + " bytes"
+	} else {
+		s = s + "\n" + m.Body
+	}
 	return s
 }
 
-//ID returns message if
+//IsBinary returns true if the message has a binary payload
+func (m *Message) IsBinary() bool {
+	return m.Raw != nil
+}
+
+//Bytes returns the payload of the message
+func (m *Message) Bytes() []byte {
+	if m.IsBinary() {
+		return m.Raw
+	}
+	return []byte(m.Body)
+}
+
+//Text returns the payload of the message as a string
+func (m *Message) Text() string {
+	if m.IsBinary() {
+		return string(m.Raw)
+	}
+	return m.Body
+}
+
+//ID returns message id
 func (m *Message) ID() string {
-	return m.Header["id"]
+	return m.System.ID
 }
 
 //ContentType returns content-type
 func (m *Message) ContentType() string {
-	return m.Header["content-type"]
+	return m.System.ContentType
 }
 
-//ApplicationType returns application-type. Empty if content-type is not application/json
+//ApplicationType returns application-type, the Go type of the data sent
 func (m *Message) ApplicationType() string {
-	return m.Header["application-type"]
+	return m.System.ApplicationType
 }
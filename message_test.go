@@ -1,7 +1,10 @@
 package wsqueue
 
 import (
+	"context"
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -35,3 +38,170 @@ func TestNewMessageShouldBeJSONEvenIfPointer(t *testing.T) {
 	assert.Equal(t, msg.ContentType(), "application/json")
 	assert.Equal(t, msg.ApplicationType(), "map[string]interface {}")
 }
+
+func TestNewMessageShouldHandleAllNumericKinds(t *testing.T) {
+	var i32 int32 = -32
+	var u8 uint8 = 8
+	var f32 float32 = 1.5
+	var b = true
+	var s = "pointer"
+	tests := []struct {
+		data        interface{}
+		contentType string
+		appType     string
+		body        string
+	}{
+		{42, "int", "int", "42"},
+		{int64(-64), "int", "int64", "-64"},
+		{&i32, "int", "int32", "-32"},
+		{u8, "uint", "uint8", "8"},
+		{&f32, "float", "float32", "1.5"},
+		{3.14, "float", "float64", "3.14"},
+		{&b, "bool", "bool", "true"},
+		{&s, "string", "string", "pointer"},
+	}
+	for _, test := range tests {
+		msg, err := newMessage(test.data)
+		assert.NoError(t, err)
+		assert.Equal(t, test.contentType, msg.ContentType())
+		assert.Equal(t, test.appType, msg.ApplicationType())
+		assert.Equal(t, test.body, msg.Body)
+	}
+
+	_, err := newMessage(nil)
+	assert.Error(t, err)
+}
+
+type testPayload struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func TestDecodeShouldCheckApplicationType(t *testing.T) {
+	msg, err := newMessage(int32(-12))
+	assert.NoError(t, err)
+	i, err := Decode[int32](*msg)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(-12), i)
+	_, err = Decode[int64](*msg)
+	assert.Error(t, err)
+	_, err = Decode[string](*msg)
+	assert.Error(t, err)
+
+	msg, err = newMessage(uint16(65535))
+	assert.NoError(t, err)
+	u, err := Decode[uint16](*msg)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(65535), u)
+
+	msg, err = newMessage(&testPayload{Name: "foo", Count: 2})
+	assert.NoError(t, err)
+	p, err := Decode[testPayload](*msg)
+	assert.NoError(t, err)
+	assert.Equal(t, testPayload{Name: "foo", Count: 2}, p)
+	pp, err := Decode[*testPayload](*msg)
+	assert.NoError(t, err)
+	assert.Equal(t, &testPayload{Name: "foo", Count: 2}, pp)
+
+	msg, err = newMessage(true)
+	assert.NoError(t, err)
+	b, err := Decode[bool](*msg)
+	assert.NoError(t, err)
+	assert.True(t, b)
+}
+
+func TestNewMessageShouldBeBinary(t *testing.T) {
+	data := []byte{0, 1, 2, 255}
+	msg, err := newMessage(data)
+	assert.NoError(t, err)
+	assert.True(t, msg.IsBinary())
+	assert.Equal(t, ContentTypeBinary, msg.ContentType())
+	assert.Equal(t, data, msg.Bytes())
+	assert.Equal(t, string(data), msg.Text())
+
+	b, err := Decode[[]byte](*msg)
+	assert.NoError(t, err)
+	assert.Equal(t, data, b)
+	_, err = Decode[string](*msg)
+	assert.Error(t, err)
+
+	msg = newBinaryMessage("image/png", data)
+	assert.Equal(t, "image/png", msg.ContentType())
+	for _, codec := range []Codec{JSONCodec, MessagePackCodec, CBORCodec} {
+		b, err := codec.Marshal(msg)
+		assert.NoError(t, err, codec.Name())
+		decoded := &Message{}
+		assert.NoError(t, codec.Unmarshal(b, decoded), codec.Name())
+		assert.Equal(t, data, decoded.Bytes(), codec.Name())
+		assert.Equal(t, "image/png", decoded.ContentType(), codec.Name())
+	}
+
+	text, err := newMessage("text")
+	assert.NoError(t, err)
+	assert.False(t, text.IsBinary())
+	assert.Equal(t, []byte("text"), text.Bytes())
+}
+
+func TestHeaderShouldHaveTypedAccessors(t *testing.T) {
+	h := Header{}
+	now := time.Now()
+	h.SetTime("deadline", now)
+	h.SetInt("retries", 3)
+	d, err := h.Time("deadline")
+	assert.NoError(t, err)
+	assert.True(t, now.Equal(d))
+	i, err := h.Int("retries")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, i)
+	_, err = h.Int("unknown")
+	assert.Error(t, err)
+
+	h[HeaderPartitionKey] = "foo"
+	assert.NoError(t, h.validate())
+	h[HeaderDeadLetterReason] = "foo"
+	assert.True(t, errors.Is(h.validate(), ErrReservedHeader))
+}
+
+func TestMessageShouldExpireAfterTTL(t *testing.T) {
+	m, err := NewMessage("foo")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, m.ID())
+	assert.False(t, m.Expired())
+	m.System.TTL = time.Millisecond
+	m.System.Timestamp = time.Now().Add(-time.Second)
+	assert.True(t, m.Expired())
+}
+
+func TestQueueShouldSendUserHeadersAndDropExpiredMessages(t *testing.T) {
+	s, c, closeFunc := newTestServer(t, "/TestHeaders")
+	defer closeFunc()
+	q := s.CreateQueue("queue", 10)
+
+	assert.True(t, errors.Is(q.SendWithHeaders("foo", Header{HeaderDeadLetterSource: "foo"}), ErrReservedHeader))
+	expired, _ := NewMessage("expired")
+	expired.System.TTL = time.Millisecond
+	assert.NoError(t, q.SendMessage(expired))
+	reply := &Message{Body: "reply", System: SystemHeader{ContentType: "string", CorrelationID: "request"}}
+	assert.NoError(t, q.SendMessage(reply))
+	assert.NoError(t, q.SendWithHeaders("foo", Header{"project": "bar"}))
+	time.Sleep(10 * time.Millisecond)
+
+	sub, err := c.ListenContext(context.Background(), "queue")
+	assert.NoError(t, err)
+	for _, expected := range []string{"reply", "foo"} {
+		select {
+		case m := <-sub.Messages:
+			assert.Equal(t, expected, m.Text())
+			assert.NotEmpty(t, m.ID())
+			assert.False(t, m.System.Received.IsZero())
+			if expected == "reply" {
+				assert.Equal(t, "request", m.System.CorrelationID)
+			} else {
+				assert.Equal(t, "bar", m.Header["project"])
+			}
+			assert.NoError(t, c.Ack(&m))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Message %s not received", expected)
+		}
+	}
+}
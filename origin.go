@@ -0,0 +1,65 @@
+package wsqueue
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+//originChecker returns the CheckOrigin function of the websocket upgrader.
+//Options overrides the server settings. If nothing is set, every origin is allowed.
+func (s *Server) originChecker(options *Options) func(r *http.Request) bool {
+	checkOrigin, allowedOrigins := s.CheckOrigin, s.AllowedOrigins
+	if options != nil {
+		if options.CheckOrigin != nil {
+			checkOrigin = options.CheckOrigin
+		}
+		if len(options.AllowedOrigins) > 0 {
+			allowedOrigins = options.AllowedOrigins
+		}
+	}
+	if checkOrigin != nil {
+		return checkOrigin
+	}
+	if len(allowedOrigins) == 0 {
+		return func(r *http.Request) bool { return true }
+	}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		//Non-browser clients don't send any Origin header
+		if origin == "" {
+			return true
+		}
+		if matchOrigin(allowedOrigins, origin) {
+			return true
+		}
+		Warnfunc("Origin %s not allowed", origin)
+		return false
+	}
+}
+
+//matchOrigin checks origin against patterns such as "https://*.example.com".
+//A pattern without scheme matches the host of the origin whatever the scheme is.
+func matchOrigin(patterns []string, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	origin = strings.ToLower(origin)
+	host := strings.ToLower(u.Host)
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if p == "*" {
+			return true
+		}
+		s := origin
+		if !strings.Contains(p, "://") {
+			s = host
+		}
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
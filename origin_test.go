@@ -0,0 +1,37 @@
+package wsqueue
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchOrigin(t *testing.T) {
+	patterns := []string{"https://*.example.com", "localhost:*"}
+	assert.True(t, matchOrigin(patterns, "https://www.example.com"))
+	assert.True(t, matchOrigin(patterns, "https://WWW.Example.com"))
+	assert.False(t, matchOrigin(patterns, "http://www.example.com"))
+	assert.False(t, matchOrigin(patterns, "https://example.com.evil.org"))
+	assert.True(t, matchOrigin(patterns, "http://localhost:9000"))
+	assert.True(t, matchOrigin(patterns, "https://localhost:443"))
+	assert.False(t, matchOrigin(patterns, "http://localhost"))
+	assert.True(t, matchOrigin([]string{"*"}, "http://foo.bar"))
+}
+
+func TestOriginCheckerShouldUseOptionsOverServer(t *testing.T) {
+	s := &Server{AllowedOrigins: []string{"https://server.example.com"}}
+	o := &Options{AllowedOrigins: []string{"https://topic.example.com"}}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Origin", "https://server.example.com")
+	assert.True(t, s.originChecker(nil)(r))
+	assert.False(t, s.originChecker(o)(r))
+
+	r.Header.Set("Origin", "https://topic.example.com")
+	assert.False(t, s.originChecker(nil)(r))
+	assert.True(t, s.originChecker(o)(r))
+
+	r.Header.Del("Origin")
+	assert.True(t, s.originChecker(o)(r), "request without origin should be allowed")
+}
@@ -0,0 +1,224 @@
+package wsqueue
+
+import (
+	"container/list"
+	"time"
+)
+
+//HeaderPartitionKey is the header holding the partition key of a message. On an
+//ordered queue, all the messages with the same partition key are sent to the same
+//consumer, one at a time, in FIFO order. A key is moved to another consumer when its
+//consumer exits, or when it has been idle while many other keys were used. It is a
+//user header, set by SendWithKey or by the producer
+const HeaderPartitionKey = "partition-key"
+
+//maxPartitionOwners is the max number of idle partition keys whose consumer is kept
+const maxPartitionOwners = 10000
+
+//partition holds the messages of a partition key on an ordered queue
+type partition struct {
+	//owner is the consumer of the partition, until it exits the queue
+	owner ConnID
+	//pending are the messages waiting for the previous one to be acknowledged
+	pending []*Message
+	//busy is the ID of the message sent and not yet acknowledged
+	busy string
+}
+
+//SendWithKey sends a message with a partition key. See Options.Ordered
+func (q *Queue) SendWithKey(key string, data interface{}) error {
+	m, e := newMessage(data)
+	if e != nil {
+		return e
+	}
+	m.Header[HeaderPartitionKey] = key
+	return q.post(m)
+}
+
+//partitionKey returns the partition key of m if the queue is ordered. The queue mutex must be held
+func (q *Queue) partitionKey(m *Message) string {
+	if q.Options == nil || !q.Options.Ordered {
+		return ""
+	}
+	return m.Header[HeaderPartitionKey]
+}
+
+//sendOrdered appends m to its partition and dispatches the partition
+func (q *Queue) sendOrdered(key string, m *Message) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	p, ok := q.partitions[key]
+	if !ok {
+		p = &partition{}
+		p.owner, _ = q.owners.get(key)
+		q.partitions[key] = p
+	}
+	p.pending = append(p.pending, m)
+	q.dispatchPartition(p)
+}
+
+//dispatchPartition sends the next message of a partition if the previous one has
+//been acknowledged. The queue mutex must be held
+func (q *Queue) dispatchPartition(p *partition) {
+	for len(p.pending) > 0 && p.pending[0].Expired() {
+		Logfunc("Message %s expired on %s. Dropping", p.pending[0].ID(), q.Queue)
+		p.pending = p.pending[1:]
+	}
+	if p.busy != "" || len(p.pending) == 0 {
+		return
+	}
+	m := p.pending[0]
+	conn, ok := q.wsConnections[p.owner]
+	if !ok {
+		//The partition is assigned to a new consumer chosen by the load balancer
+		conn = q.next(m)
+		if conn == nil {
+			return
+		}
+		p.owner = conn.ID
+	} else if !q.hasCredits(conn) {
+		return
+	}
+	if err := q.write(conn, m); err != nil {
+		Logfunc("Error while sending to %s : %s", conn.ID, err.Error())
+		return
+	}
+	p.pending = p.pending[1:]
+	p.busy = m.ID()
+}
+
+//dispatchPartitions dispatches all the partitions and deletes the idle ones
+func (q *Queue) dispatchPartitions() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for key, p := range q.partitions {
+		q.dispatchPartition(p)
+		if p.busy == "" && len(p.pending) == 0 {
+			q.forgetPartition(key, p)
+		}
+	}
+}
+
+//releasePartition releases the partition of m after an ack. If requeue is true, m is
+//put back at the head of the partition. An idle partition is deleted. It returns false
+//if m doesn't belong to a partition. The queue mutex must be held
+func (q *Queue) releasePartition(m *Message, requeue bool) bool {
+	key := m.Header[HeaderPartitionKey]
+	p, ok := q.partitions[key]
+	if !ok || p.busy != m.ID() {
+		return false
+	}
+	p.busy = ""
+	if requeue {
+		p.pending = append([]*Message{m}, p.pending...)
+	}
+	if len(p.pending) == 0 {
+		q.forgetPartition(key, p)
+	}
+	return true
+}
+
+//forgetPartition deletes an idle partition. Its consumer is kept, so that the next
+//messages with its key are sent to the same consumer. The queue mutex must be held
+func (q *Queue) forgetPartition(key string, p *partition) {
+	if p.owner != "" {
+		q.owners.set(key, p.owner, maxPartitionOwners)
+	}
+	delete(q.partitions, key)
+}
+
+//pending returns the number of messages waiting in the partitions. The queue mutex must be held
+func (q *Queue) pending() int {
+	n := 0
+	for _, p := range q.partitions {
+		n += len(p.pending)
+	}
+	return n
+}
+
+//waitForPartitions waits for room in the partitions before m is sent on an ordered
+//queue: as in the Stack, pending messages are limited by the capacity of the queue
+func (q *Queue) waitForPartitions(m *Message) {
+	f := NewFibonacci()
+	for {
+		q.mutex.RLock()
+		max := q.capacity()
+		full := q.partitionKey(m) != "" && max > 0 && q.pending() >= max
+		q.mutex.RUnlock()
+		if !full {
+			return
+		}
+		Warnfunc("Partitions of %s are full. Waiting...", q.Queue)
+		f.WaitForIt(time.Second)
+	}
+}
+
+//leavePartitions unassigns the partitions and the keys of an exited consumer, which
+//are rebalanced on the next dispatch. The queue mutex must be held
+func (q *Queue) leavePartitions(c *Conn) {
+	q.owners.leave(c.ID)
+	for key, p := range q.partitions {
+		if p.owner != c.ID {
+			continue
+		}
+		p.owner = ""
+		if p.busy == "" && len(p.pending) == 0 {
+			delete(q.partitions, key)
+		}
+	}
+}
+
+//partitionOwner is an idle partition key and its consumer
+type partitionOwner struct {
+	key   string
+	owner ConnID
+}
+
+//partitionOwners is a LRU cache of the consumers of the idle partitions. The queue
+//mutex must be held
+type partitionOwners struct {
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+func newPartitionOwners() *partitionOwners {
+	return &partitionOwners{
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+//get returns the consumer of key
+func (o *partitionOwners) get(key string) (ConnID, bool) {
+	e, ok := o.entries[key]
+	if !ok {
+		return "", false
+	}
+	return e.Value.(*partitionOwner).owner, true
+}
+
+//set records the consumer of key. The cache keeps at most size keys, the least
+//recently set are evicted first
+func (o *partitionOwners) set(key string, owner ConnID, size int) {
+	if e, ok := o.entries[key]; ok {
+		e.Value.(*partitionOwner).owner = owner
+		o.order.MoveToFront(e)
+		return
+	}
+	o.entries[key] = o.order.PushFront(&partitionOwner{key: key, owner: owner})
+	for o.order.Len() > size {
+		e := o.order.Back()
+		o.order.Remove(e)
+		delete(o.entries, e.Value.(*partitionOwner).key)
+	}
+}
+
+//leave forgets the keys of an exited consumer
+func (o *partitionOwners) leave(owner ConnID) {
+	for key, e := range o.entries {
+		if e.Value.(*partitionOwner).owner == owner {
+			o.order.Remove(e)
+			delete(o.entries, key)
+		}
+	}
+}
@@ -1,8 +1,7 @@
 package wsqueue
 
 import (
-	"encoding/json"
-	"errors"
+	"sort"
 	"sync"
 	"time"
 )
@@ -33,10 +32,16 @@ type Queue struct {
 	ackHandler            func(*Conn, *Message) error
 	mutex                 *sync.RWMutex
 	wsConnections         map[ConnID]*Conn
-	acks                  map[*Message]bool
-	lb                    *loadBalancer
+	inflight              map[ConnID]map[string]*Message
+	held                  map[ConnID][]*Message
+	partitions            map[string]*partition
+	owners                *partitionOwners
+	lb                    LoadBalancer
 	store                 StorageDriver
 	stopQueue             chan bool
+	credits               chan bool
+	server                *Server
+	dedup                 *dedupCache
 }
 
 //CreateQueue create queue
@@ -51,14 +56,19 @@ func (s *Server) newQueue(name string, bufferSize int) (*Queue, error) {
 		Queue:         name,
 		mutex:         &sync.RWMutex{},
 		wsConnections: make(map[ConnID]*Conn),
-		acks:          make(map[*Message]bool),
+		inflight:      make(map[ConnID]map[string]*Message),
+		held:          make(map[ConnID][]*Message),
+		partitions:    make(map[string]*partition),
+		owners:        newPartitionOwners(),
+		dedup:         newDedupCache(),
 	}
-	q.lb = &loadBalancer{queue: q, counter: make(map[ConnID]int)}
+	q.lb = NewRoundRobin()
 	q.newConsumerHandler = newConsumerHandler(q)
 	q.consumerExitedHandler = consumerExitedHandler(q)
 	q.ackHandler = ackHandler(q)
 	q.store = NewStack()
 	q.stopQueue = make(chan bool, 1)
+	q.credits = make(chan bool, 1)
 	q.Options = &Options{Storage: StorageOptions{"capacity": bufferSize}}
 	return q, nil
 }
@@ -67,49 +77,146 @@ func (s *Server) newQueue(name string, bufferSize int) (*Queue, error) {
 func (s *Server) RegisterQueue(q *Queue) {
 	Logfunc("Register queue %s on route %s", q.Queue, s.RoutePrefix+"/wsqueue/queue/"+q.Queue)
 	handler := s.createHandler(
+		q.Queue,
 		q.mutex,
 		&q.wsConnections,
 		&q.newConsumerHandler,
 		&q.consumerExitedHandler,
 		&q.ackHandler,
-		q.Options,
+		q.acked,
+		&q.Options,
 	)
+	q.server = s
 	q.store.Open(q.Options)
 	q.handle(100)
-	s.Router.HandleFunc(s.RoutePrefix+"/wsqueue/queue/"+q.Queue, handler)
+	s.handle(queue, q.Queue, handler)
 	s.QueuesCounter.Add(1)
 }
 
-type loadBalancer struct {
-	queue   *Queue
-	counter map[ConnID]int
+//SetACL replaces atomically the ACL of the queue. If disconnect is true, consumers
+//which are not authorized anymore by the new ACL are closed
+func (q *Queue) SetACL(acl ACL, disconnect bool) {
+	setACL(q.mutex, &q.Options, q.wsConnections, acl, disconnect, q.server.trustedProxies())
 }
 
-func (lb *loadBalancer) next() (*ConnID, error) {
-	lb.queue.mutex.Lock()
-	defer lb.queue.mutex.Unlock()
+//SetLoadBalancer replaces the LoadBalancer of the queue. Default is RoundRobin
+func (q *Queue) SetLoadBalancer(lb LoadBalancer) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, c := range q.wsConnections {
+		q.lb.Remove(c)
+		lb.Add(c)
+	}
+	q.lb = lb
+}
+
+//next returns the consumer of m chosen by the load balancer. The queue mutex must be held
+func (q *Queue) next(m *Message) *Conn {
+	consumers := make([]*Conn, 0, len(q.wsConnections))
+	for _, c := range q.wsConnections {
+		if q.hasCredits(c) {
+			consumers = append(consumers, c)
+		}
+	}
+	if len(consumers) == 0 {
+		return nil
+	}
+	sort.Slice(consumers, func(i, j int) bool { return consumers[i].ID < consumers[j].ID })
+	return q.lb.Next(m, consumers)
+}
+
+//hasCredits checks if a consumer may receive one more message according to
+//its prefetch count. The queue mutex must be held
+func (q *Queue) hasCredits(c *Conn) bool {
+	return c.Prefetch <= 0 || len(q.inflight[c.ID]) < c.Prefetch
+}
 
-	if len(lb.queue.wsConnections) == 0 {
-		return nil, errors.New("No connection available")
+//capacity returns the "capacity" storage option of the queue. The queue mutex must be held
+func (q *Queue) capacity() int {
+	if q.Options == nil {
+		return 0
 	}
+	c, _ := q.Options.Storage["capacity"].(int)
+	return c
+}
 
-	var minCounter = maxInt
-	for id := range lb.queue.wsConnections {
-		counter := lb.counter[id]
-		if counter < minCounter {
-			minCounter = counter
+//hold keeps m aside if its consumer, chosen by a KeyedLoadBalancer, has no free credits
+//or other messages waiting. The held messages count in the capacity of the queue, beyond
+//it m is not held. The queue mutex must be held
+func (q *Queue) hold(m *Message) bool {
+	lb, ok := q.lb.(KeyedLoadBalancer)
+	if !ok {
+		return false
+	}
+	id, ok := lb.Owner(m)
+	if !ok {
+		return false
+	}
+	conn, ok := q.wsConnections[id]
+	if !ok || (len(q.held[id]) == 0 && q.hasCredits(conn)) {
+		return false
+	}
+	if max := q.capacity(); max > 0 {
+		n := 0
+		for _, ms := range q.held {
+			n += len(ms)
+		}
+		if n >= max {
+			return false
 		}
 	}
+	q.held[id] = append(q.held[id], m)
+	return true
+}
+
+//dispatchHeld sends the held messages to their consumers according to their credits.
+//It returns the messages held for consumers which have exited, to be requeued.
+//The queue mutex must be held
+func (q *Queue) dispatchHeld() []*Message {
+	var requeue []*Message
+	for id, ms := range q.held {
+		conn, ok := q.wsConnections[id]
+		if !ok {
+			requeue = append(requeue, ms...)
+			delete(q.held, id)
+			continue
+		}
+		for len(ms) > 0 && q.hasCredits(conn) {
+			if ms[0].Expired() {
+				Logfunc("Message %s expired on %s. Dropping", ms[0].ID(), q.Queue)
+			} else if err := q.write(conn, ms[0]); err != nil {
+				Logfunc("Error while sending to %s : %s", conn.ID, err.Error())
+				break
+			}
+			ms = ms[1:]
+		}
+		if len(ms) == 0 {
+			delete(q.held, id)
+		} else {
+			q.held[id] = ms
+		}
+	}
+	return requeue
+}
 
-	for id := range lb.queue.wsConnections {
-		c := lb.counter[id]
-		if c == minCounter {
-			c++
-			lb.counter[id] = c
-			return &id, nil
+//available checks if any consumer may receive a message
+func (q *Queue) available() bool {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+	for _, c := range q.wsConnections {
+		if q.hasCredits(c) {
+			return true
 		}
 	}
-	return nil, errors.New("No connection available")
+	return false
+}
+
+//refill wakes up the dispatching of stored messages
+func (q *Queue) refill() {
+	select {
+	case q.credits <- true:
+	default:
+	}
 }
 
 //Send send a message
@@ -118,47 +225,149 @@ func (q *Queue) Send(data interface{}) error {
 	if e != nil {
 		return e
 	}
-	if len(q.wsConnections) == 0 {
-		Logfunc("No consumer, pushing message to stack")
-		q.store.Push(m)
+	return q.post(m)
+}
+
+//SendWithHeaders send a message with user headers
+func (q *Queue) SendWithHeaders(data interface{}, h Header) error {
+	m, e := newMessage(data)
+	if e != nil {
+		return e
+	}
+	if m, e = m.withHeaders(h); e != nil {
+		return e
+	}
+	return q.post(m)
+}
+
+//SendMessage send a message built with NewMessage
+func (q *Queue) SendMessage(m *Message) error {
+	if e := m.check(); e != nil {
+		return e
+	}
+	return q.post(m)
+}
+
+//SendBinary send a binary message, with a MIME content-type
+func (q *Queue) SendBinary(contentType string, data []byte) error {
+	return q.post(newBinaryMessage(contentType, data))
+}
+
+//post applies the options of the queue to a new message and sends it
+func (q *Queue) post(m *Message) error {
+	return q.postBatch([]*Message{m})
+}
+
+//postBatch applies the options of the queue to new messages and sends them one by one.
+//They are buffered according to the batch size of each consumer
+func (q *Queue) postBatch(ms []*Message) error {
+	q.mutex.RLock()
+	options := q.Options
+	q.mutex.RUnlock()
+	ms, err := options.accept(q.server, q.Queue, ms, q.dedup, q.store)
+	if err != nil {
+		return err
+	}
+	for _, m := range ms {
+		q.waitForPartitions(m)
+		q.send(m)
+	}
+	return nil
+}
+
+//write sends m to conn and keeps it until it is acknowledged. If conn receives batches,
+//m is buffered. The queue mutex must be held
+func (q *Queue) write(conn *Conn, m *Message) error {
+	if conn.BatchSize > 1 {
+		q.buffer(conn, m)
 		return nil
 	}
-	q.send(m)
+	if err := conn.write(m); err != nil {
+		return err
+	}
+	q.track(conn, m)
 	return nil
 }
 
-func (q *Queue) send(m *Message) {
-	connID, err := q.lb.next()
+//track keeps m until it is acknowledged by conn. The queue mutex must be held
+func (q *Queue) track(conn *Conn, m *Message) {
+	if q.inflight[conn.ID] == nil {
+		q.inflight[conn.ID] = make(map[string]*Message)
+	}
+	q.inflight[conn.ID][m.ID()] = m
+	conn.inflight = len(q.inflight[conn.ID])
+}
+
+//untrack forgets m once it is acknowledged by conn. The queue mutex must be held
+func (q *Queue) untrack(conn *Conn, m *Message) {
+	delete(q.inflight[conn.ID], m.ID())
+	conn.inflight = len(q.inflight[conn.ID])
+}
+
+//send sends m to a consumer. If no consumer is available, m is pushed back in the store,
+//unless it is held for its consumer. Expired messages are dropped
+func (q *Queue) send(m *Message) bool {
+	if m.Expired() {
+		Logfunc("Message %s expired on %s. Dropping", m.ID(), q.Queue)
+		return true
+	}
+	q.mutex.Lock()
+	if key := q.partitionKey(m); key != "" {
+		q.mutex.Unlock()
+		q.sendOrdered(key, m)
+		return true
+	}
+	if q.hold(m) {
+		q.mutex.Unlock()
+		return true
+	}
+	conn := q.next(m)
+	var err error
+	if conn != nil {
+		err = q.write(conn, m)
+	}
+	q.mutex.Unlock()
+
+	if conn == nil {
+		Logfunc("No consumer available on %s, pushing message to stack", q.Queue)
+		q.store.Push(m)
+		return false
+	}
 	if err != nil {
-		Warnfunc("Error while sending to %s : %s", *connID, err.Error())
+		Logfunc("Error while sending to %s : %s", conn.ID, err.Error())
 		q.store.Push(m)
-	} else {
-		conn := q.wsConnections[*connID]
-		q.acks[m] = false
-		b, _ := json.Marshal(m)
-		q.mutex.Lock()
-		err := conn.WSConn.WriteMessage(1, b)
-		q.mutex.Unlock()
-		if err != nil {
-			Logfunc("Error while sending to %s : %s", *connID, err.Error())
-			q.store.Push(m)
-		}
+		return false
 	}
+	return true
 }
 
 func (q *Queue) handle(interval int64) {
 	var cont = true
 	go func(c *bool) {
 		for *c {
-			time.Sleep(time.Duration(interval) * time.Millisecond)
-			if len(q.wsConnections) > 0 {
+			select {
+			case <-time.After(time.Duration(interval) * time.Millisecond):
+			case <-q.credits:
+			}
+			q.dispatchPartitions()
+			q.mutex.Lock()
+			requeue := q.dispatchHeld()
+			q.mutex.Unlock()
+			for _, m := range requeue {
+				q.store.Push(m)
+			}
+			for q.available() {
 				data := q.store.Pop()
-				if data != nil {
-					m, b := data.(*Message)
-					if !b {
-						Warnfunc("Cannot cast %s to message", data)
-					}
-					q.send(m)
+				if data == nil {
+					break
+				}
+				m, b := data.(*Message)
+				if !b {
+					Warnfunc("Cannot cast %s to message", data)
+					continue
+				}
+				if !q.send(m) {
+					break
 				}
 			}
 		}
@@ -174,28 +383,87 @@ func (q *Queue) handle(interval int64) {
 func newConsumerHandler(q *Queue) func(*Conn) {
 	return func(c *Conn) {
 		q.mutex.Lock()
-		q.lb.counter[c.ID] = 0
-		//Reinitiatlisation du load balancer
-		for id := range q.lb.counter {
-			q.lb.counter[id] = 0
-		}
+		q.lb.Add(c)
 		q.mutex.Unlock()
+		q.refill()
 	}
 }
 
+//consumerExitedHandler requeues the messages not acknowledged by the consumer
 func consumerExitedHandler(q *Queue) func(*Conn) {
 	return func(c *Conn) {
 		q.mutex.Lock()
-		delete(q.lb.counter, c.ID)
+		q.lb.Remove(c)
+		if c.batchTimer != nil {
+			c.batchTimer.Stop()
+			c.batchTimer = nil
+		}
+		c.batch = nil
+		inflight := q.inflight[c.ID]
+		delete(q.inflight, c.ID)
+		requeue := make([]*Message, 0, len(inflight))
+		for _, m := range inflight {
+			Logfunc("Message %s not acknowledged by %s. Requeuing", m.ID(), c.ID)
+			if !q.releasePartition(m, true) {
+				requeue = append(requeue, m)
+			}
+		}
+		q.leavePartitions(c)
+		requeue = append(requeue, q.held[c.ID]...)
+		delete(q.held, c.ID)
 		q.mutex.Unlock()
+
+		for _, m := range requeue {
+			q.store.Push(m)
+		}
+		q.refill()
 	}
 }
 
+//acked checks if a frame only holds acks or nacks of messages in flight on c
+func (q *Queue) acked(c *Conn, messages []Message) bool {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+	for i := range messages {
+		m := &messages[i]
+		id := m.System.Nack
+		if id == "" {
+			id = m.System.Ack
+		}
+		if !m.isAck() || q.inflight[c.ID][id] == nil {
+			return false
+		}
+	}
+	return len(messages) > 0
+}
+
+//ackHandler handles acks and nacks sent by consumers. A nacked message is requeued
 func ackHandler(q *Queue) func(*Conn, *Message) error {
 	return func(c *Conn, m *Message) error {
+		id, nack := m.System.Nack, m.System.Nack != ""
+		if !nack {
+			id = m.System.Ack
+		}
+		if id == "" {
+			return nil
+		}
+
 		q.mutex.Lock()
-		q.acks[m] = true
+		msg := q.inflight[c.ID][id]
+		delete(q.inflight[c.ID], id)
+		c.inflight = len(q.inflight[c.ID])
+		ordered := msg != nil && q.releasePartition(msg, nack)
 		q.mutex.Unlock()
+
+		if msg == nil {
+			Warnfunc("Unknown message %s acknowledged by %s", id, c.ID)
+			return nil
+		}
+		if nack && !ordered {
+			Logfunc("Message %s rejected by %s. Requeuing", id, c.ID)
+			q.store.Push(msg)
+		}
+		q.refill()
 		return nil
 	}
 }
@@ -0,0 +1,123 @@
+package wsqueue
+
+import (
+	"sync"
+	"time"
+)
+
+//LimitOptions limits connections and inbound messages per client identity
+//(username if authenticated, IP otherwise). Zero values mean no limit
+type LimitOptions struct {
+	//MaxConnections is the max number of concurrent connections per client
+	MaxConnections int `json:"max_connections,omitempty"`
+	//MessageRate is the number of inbound messages per second allowed per client
+	MessageRate float64 `json:"message_rate,omitempty"`
+	//MessageBurst is the max number of inbound messages allowed at once. Default is 1.
+	//A batch counts as many messages as it holds
+	MessageBurst int `json:"message_burst,omitempty"`
+}
+
+//tokenBucket is a token bucket filled at rate tokens per second up to burst tokens
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+//refill adds the tokens earned since the last refill and returns true if the bucket is full
+func (b *tokenBucket) refill(now time.Time, rate float64, burst int) bool {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	b.last = now
+	if b.tokens >= float64(burst) {
+		b.tokens = float64(burst)
+		return true
+	}
+	return false
+}
+
+func (b *tokenBucket) take(now time.Time, rate float64, burst int) bool {
+	return b.takeN(now, rate, burst, 1)
+}
+
+//takeN takes n tokens at once, or none if there are not enough tokens
+func (b *tokenBucket) takeN(now time.Time, rate float64, burst int, n int) bool {
+	b.refill(now, rate, normalizeBurst(burst))
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+func normalizeBurst(burst int) int {
+	if burst < 1 {
+		return 1
+	}
+	return burst
+}
+
+//limiter keeps track of connections and message rates of the clients of a topic or a queue
+type limiter struct {
+	mutex       *sync.Mutex
+	connections map[string]int
+	buckets     map[string]*tokenBucket
+}
+
+func newLimiter() *limiter {
+	return &limiter{
+		mutex:       &sync.Mutex{},
+		connections: make(map[string]int),
+		buckets:     make(map[string]*tokenBucket),
+	}
+}
+
+//acquire registers a connection for key, unless there is already max connections
+func (l *limiter) acquire(key string, max int) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if max > 0 && l.connections[key] >= max {
+		return false
+	}
+	l.connections[key]++
+	return true
+}
+
+//release unregisters a connection for key. The buckets of the disconnected clients are
+//kept until they are full again, so reconnecting does not refill the burst
+func (l *limiter) release(key string, rate float64, burst int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.connections[key]--
+	if l.connections[key] <= 0 {
+		delete(l.connections, key)
+	}
+	now := time.Now()
+	burst = normalizeBurst(burst)
+	for k, b := range l.buckets {
+		if _, ok := l.connections[k]; !ok && (rate <= 0 || b.refill(now, rate, burst)) {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+//allow checks the message rate of key
+func (l *limiter) allow(key string, rate float64, burst int) bool {
+	return l.allowN(key, rate, burst, 1)
+}
+
+//allowN checks the message rate of key for n messages received at once. They are all
+//allowed or all rejected: more than burst messages are always rejected
+func (l *limiter) allowN(key string, rate float64, burst int, n int) bool {
+	if rate <= 0 {
+		return true
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	burst = normalizeBurst(burst)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		l.buckets[key] = b
+	}
+	return b.takeN(now, rate, burst, n)
+}
@@ -0,0 +1,214 @@
+package wsqueue
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucketShouldRefillAtRate(t *testing.T) {
+	now := time.Now()
+	b := &tokenBucket{tokens: 2, last: now}
+	assert.True(t, b.take(now, 10, 2))
+	assert.True(t, b.take(now, 10, 2))
+	assert.False(t, b.take(now, 10, 2), "bucket should be empty")
+
+	now = now.Add(100 * time.Millisecond)
+	assert.True(t, b.take(now, 10, 2), "one token should have been added")
+	assert.False(t, b.take(now, 10, 2))
+
+	now = now.Add(time.Hour)
+	assert.True(t, b.take(now, 10, 2))
+	assert.True(t, b.take(now, 10, 2))
+	assert.False(t, b.take(now, 10, 2), "bucket should not exceed burst")
+}
+
+func TestLimiterShouldLimitConnectionsPerKey(t *testing.T) {
+	l := newLimiter()
+	assert.True(t, l.acquire("foo", 2))
+	assert.True(t, l.acquire("foo", 2))
+	assert.False(t, l.acquire("foo", 2))
+	assert.True(t, l.acquire("bar", 2))
+
+	l.release("foo", 0, 0)
+	assert.True(t, l.acquire("foo", 2))
+	assert.True(t, l.acquire("foo", 0), "0 means no limit")
+}
+
+func TestLimiterShouldKeepBucketsUntilRefilled(t *testing.T) {
+	l := newLimiter()
+	assert.True(t, l.acquire("foo", 0))
+	assert.True(t, l.allow("foo", 0.001, 0), "first message should be allowed")
+	assert.False(t, l.allow("foo", 0.001, 0))
+	l.release("foo", 0.001, 0)
+	assert.True(t, l.acquire("foo", 0))
+	assert.False(t, l.allow("foo", 0.001, 0), "reconnecting should not refill the bucket")
+
+	l.release("foo", 1000, 0)
+	assert.True(t, l.acquire("bar", 0))
+	time.Sleep(10 * time.Millisecond)
+	l.release("bar", 1000, 0)
+	assert.Empty(t, l.buckets, "refilled buckets should be deleted")
+}
+
+func TestServerShouldLimitConnectionsAndMessages(t *testing.T) {
+	s, c, closeFunc := newTestServer(t, "/TestLimits")
+	defer closeFunc()
+	topic := s.CreateTopic("topic")
+	received := make(chan *Message, 10)
+	topic.mutex.Lock()
+	topic.Options = &Options{Limits: LimitOptions{MaxConnections: 1, MessageRate: 0.001}}
+	topic.OnMessageHandler = func(conn *Conn, m *Message) error {
+		received <- m
+		return nil
+	}
+	topic.mutex.Unlock()
+	url := "ws://" + c.Host + c.Route + "wsqueue/topic/topic"
+	send := func(conn *websocket.Conn, data string) {
+		m, _ := newMessage(data)
+		b, _ := JSONCodec.Marshal(m)
+		assert.NoError(t, conn.WriteMessage(websocket.TextMessage, b))
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	assert.NoError(t, err)
+	waitForConnections(t, topic, 1)
+
+	//X-Forwarded-For is ignored without trusted proxies
+	rejectedConnections := s.RejectedConnectionsCounter.Value()
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"X-Forwarded-For": {"10.0.0.1"}})
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, rejectedConnections+1, s.RejectedConnectionsCounter.Value())
+
+	//The first message is allowed by the default burst, the second one is dropped
+	rejectedMessages := s.RejectedMessagesCounter.Value()
+	send(conn, "foo")
+	send(conn, "bar")
+	select {
+	case m := <-received:
+		assert.Equal(t, "foo", m.Text())
+	case <-time.After(5 * time.Second):
+		t.Fatal("Message not received")
+	}
+	for i := 0; i < 100 && s.RejectedMessagesCounter.Value() == rejectedMessages; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, rejectedMessages+1, s.RejectedMessagesCounter.Value())
+
+	//Reconnecting does not refill the bucket
+	conn.Close()
+	waitForConnections(t, topic, 0)
+	conn, _, err = websocket.DefaultDialer.Dial(url, nil)
+	assert.NoError(t, err)
+	defer conn.Close()
+	waitForConnections(t, topic, 1)
+	send(conn, "baz")
+	for i := 0; i < 100 && s.RejectedMessagesCounter.Value() == rejectedMessages+1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, rejectedMessages+2, s.RejectedMessagesCounter.Value())
+	assert.Empty(t, received)
+}
+
+func TestOnlyAcksOfMessagesInFlightShouldNotBeRateLimited(t *testing.T) {
+	s, c, closeFunc := newTestServer(t, "/TestAckLimits")
+	defer closeFunc()
+	limits := LimitOptions{MessageRate: 0.001}
+	topic := s.CreateTopic("topic")
+	received := make(chan *Message, 10)
+	topic.mutex.Lock()
+	topic.Options = &Options{Limits: limits}
+	topic.OnMessageHandler = func(conn *Conn, m *Message) error {
+		received <- m
+		return nil
+	}
+	topic.mutex.Unlock()
+	q := s.CreateQueue("queue", 10)
+	q.mutex.Lock()
+	q.Options.Limits = limits
+	q.mutex.Unlock()
+
+	ack := func(conn *websocket.Conn, id string) {
+		b, _ := JSONCodec.Marshal(&Message{System: SystemHeader{Ack: id}})
+		assert.NoError(t, conn.WriteMessage(websocket.TextMessage, b))
+	}
+	waitForRejected := func(n int64) {
+		for i := 0; i < 100 && s.RejectedMessagesCounter.Value() < n; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, n, s.RejectedMessagesCounter.Value())
+	}
+
+	//Acks sent to a topic are limited and not handled
+	rejected := s.RejectedMessagesCounter.Value()
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+c.Host+c.Route+"wsqueue/topic/topic", nil)
+	assert.NoError(t, err)
+	waitForConnections(t, topic, 1)
+	ack(conn, "foo")
+	ack(conn, "bar")
+	waitForRejected(rejected + 1)
+	assert.Empty(t, received)
+	conn.Close()
+
+	//Acks of unknown messages sent to a queue are limited
+	conn, _, err = websocket.DefaultDialer.Dial("ws://"+c.Host+c.Route+"wsqueue/queue/queue", nil)
+	assert.NoError(t, err)
+	defer conn.Close()
+	waitForConsumers(t, q, 1)
+	ack(conn, "foo")
+	ack(conn, "bar")
+	waitForRejected(rejected + 2)
+}
+
+func TestLimiterShouldChargeEachMessageOfABatch(t *testing.T) {
+	l := newLimiter()
+	assert.False(t, l.allowN("foo", 0.001, 2, 3), "batch larger than the burst should be rejected")
+	assert.True(t, l.allowN("foo", 0.001, 2, 2))
+	assert.False(t, l.allow("foo", 0.001, 2))
+}
+
+func TestServerShouldLimitEachMessageOfABatch(t *testing.T) {
+	s, c, closeFunc := newTestServer(t, "/TestBatchLimits")
+	defer closeFunc()
+	topic := s.CreateTopic("topic")
+	received := make(chan *Message, 10)
+	topic.mutex.Lock()
+	topic.Options = &Options{Limits: LimitOptions{MessageRate: 0.001, MessageBurst: 2}}
+	topic.OnMessageHandler = func(conn *Conn, m *Message) error {
+		received <- m
+		return nil
+	}
+	topic.mutex.Unlock()
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+c.Host+c.Route+"wsqueue/topic/topic", nil)
+	assert.NoError(t, err)
+	defer conn.Close()
+	waitForConnections(t, topic, 1)
+	send := func(data ...string) {
+		ms := []*Message{}
+		for _, d := range data {
+			m, _ := newMessage(d)
+			ms = append(ms, m)
+		}
+		b, _ := JSONCodec.Marshal(newBatchMessage(ms))
+		assert.NoError(t, conn.WriteMessage(websocket.TextMessage, b))
+	}
+
+	//The whole frame is dropped if its messages exceed the burst
+	rejected := s.RejectedMessagesCounter.Value()
+	send("a", "b", "c")
+	send("d", "e")
+	for _, expected := range []string{"d", "e"} {
+		select {
+		case m := <-received:
+			assert.Equal(t, expected, m.Text())
+		case <-time.After(5 * time.Second):
+			t.Fatal("Message not received")
+		}
+	}
+	assert.Equal(t, rejected+3, s.RejectedMessagesCounter.Value())
+	assert.Empty(t, received)
+}
@@ -0,0 +1,114 @@
+package wsqueue
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+//ErrInvalidMessage is returned when a message doesn't match the schema of its application-type
+var ErrInvalidMessage = errors.New("Invalid message")
+
+const (
+	//HeaderDeadLetterReason is set on dead-lettered messages with the validation error
+	HeaderDeadLetterReason = HeaderReservedPrefix + "dead-letter-reason"
+	//HeaderDeadLetterSource is set on dead-lettered messages with their original destination
+	HeaderDeadLetterSource = HeaderReservedPrefix + "dead-letter-source"
+)
+
+//SchemaRegistry holds the JSON schemas of messages, keyed by application-type. It
+//is safe to share a registry between several topics and queues
+type SchemaRegistry struct {
+	mutex   *sync.RWMutex
+	schemas map[string]*gojsonschema.Schema
+}
+
+//NewSchemaRegistry returns an empty schema registry
+func NewSchemaRegistry() *SchemaRegistry {
+	return &SchemaRegistry{
+		mutex:   &sync.RWMutex{},
+		schemas: make(map[string]*gojsonschema.Schema),
+	}
+}
+
+//Register compiles a JSON schema and registers it for an application-type, the Go
+//type of the data sent (ex: main.Order). It replaces any schema of the same type
+func (r *SchemaRegistry) Register(applicationType string, schema string) error {
+	s, err := gojsonschema.NewSchema(gojsonschema.NewStringLoader(schema))
+	if err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.schemas[applicationType] = s
+	return nil
+}
+
+//RegisterSchema registers a JSON schema for the messages of type T
+func RegisterSchema[T any](r *SchemaRegistry, schema string) error {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return r.Register(t.String(), schema)
+}
+
+//Validate checks a message against the schema of its application-type. Messages
+//without registered schema are valid
+func (r *SchemaRegistry) Validate(m *Message) error {
+	r.mutex.RLock()
+	schema, ok := r.schemas[m.ApplicationType()]
+	r.mutex.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	var document gojsonschema.JSONLoader
+	switch {
+	case m.IsBinary():
+		return fmt.Errorf("%w: cannot validate binary payload of %s", ErrInvalidMessage, m.ApplicationType())
+	case m.ContentType() == "string":
+		document = gojsonschema.NewGoLoader(m.Body)
+	default:
+		document = gojsonschema.NewStringLoader(m.Body)
+	}
+
+	result, err := schema.Validate(document)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidMessage, err.Error())
+	}
+	if !result.Valid() {
+		reasons := make([]string, 0, len(result.Errors()))
+		for _, e := range result.Errors() {
+			reasons = append(reasons, e.String())
+		}
+		return fmt.Errorf("%w: %s", ErrInvalidMessage, strings.Join(reasons, "; "))
+	}
+	return nil
+}
+
+//validate checks m against the schemas of the options
+func (o *Options) validate(m *Message) error {
+	if o == nil || o.Schemas == nil {
+		return nil
+	}
+	return o.Schemas.Validate(m)
+}
+
+//deadLetter sends an invalid message to the dead-letter queue of the options, if any
+func (o *Options) deadLetter(destination string, m *Message, reason error) {
+	if o == nil || o.DeadLetter == nil {
+		return
+	}
+	Logfunc("Message %s rejected by %s. Sending to dead-letter queue %s", m.ID(), destination, o.DeadLetter.Queue)
+	if m.Header == nil {
+		m.Header = Header{}
+	}
+	m.Header[HeaderDeadLetterReason] = reason.Error()
+	m.Header[HeaderDeadLetterSource] = destination
+	o.DeadLetter.send(m)
+}
@@ -0,0 +1,83 @@
+package wsqueue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testPayloadSchema = `{
+	"type": "object",
+	"properties": {
+		"name": {"type": "string", "minLength": 1},
+		"count": {"type": "integer", "minimum": 0}
+	},
+	"required": ["name"]
+}`
+
+func TestSchemaRegistryShouldValidateMessages(t *testing.T) {
+	r := NewSchemaRegistry()
+	assert.Error(t, r.Register("main.Broken", "{"))
+	assert.NoError(t, RegisterSchema[*testPayload](r, testPayloadSchema))
+	assert.NoError(t, r.Register("string", `{"type": "string", "maxLength": 3}`))
+
+	valid, _ := newMessage(testPayload{Name: "foo", Count: 2})
+	assert.NoError(t, r.Validate(valid))
+	invalid, _ := newMessage(testPayload{Count: -1})
+	assert.True(t, errors.Is(r.Validate(invalid), ErrInvalidMessage))
+
+	short, _ := newMessage("foo")
+	assert.NoError(t, r.Validate(short))
+	long, _ := newMessage("foobar")
+	assert.True(t, errors.Is(r.Validate(long), ErrInvalidMessage))
+
+	unknown, _ := newMessage(42)
+	assert.NoError(t, r.Validate(unknown))
+}
+
+func TestQueueShouldDeadLetterInvalidMessages(t *testing.T) {
+	s, c, closeFunc := newTestServer(t, "/TestSchema")
+	defer closeFunc()
+	dlq := s.CreateQueue("dead-letter", 10)
+	q := s.CreateQueue("queue", 10)
+	r := NewSchemaRegistry()
+	assert.NoError(t, RegisterSchema[testPayload](r, testPayloadSchema))
+	q.mutex.Lock()
+	q.Options.Schemas = r
+	q.mutex.Unlock()
+
+	assert.True(t, errors.Is(Send(q, testPayload{}), ErrInvalidMessage))
+	assert.NoError(t, Send(q, testPayload{Name: "foo"}))
+
+	q.mutex.Lock()
+	q.Options.DeadLetter = dlq
+	q.mutex.Unlock()
+	assert.True(t, errors.Is(Send(q, testPayload{Count: 1}), ErrInvalidMessage))
+
+	sub, err := c.ListenContext(context.Background(), "queue")
+	assert.NoError(t, err)
+	dead, err := c.ListenContext(context.Background(), "dead-letter")
+	assert.NoError(t, err)
+
+	select {
+	case m := <-sub.Messages:
+		p, err := Decode[testPayload](m)
+		assert.NoError(t, err)
+		assert.Equal(t, "foo", p.Name)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Valid message not received")
+	}
+	select {
+	case m := <-dead.Messages:
+		p, err := Decode[testPayload](m)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, p.Count)
+		assert.Equal(t, "queue", m.Header[HeaderDeadLetterSource])
+		assert.Contains(t, m.Header[HeaderDeadLetterReason], "name")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Invalid message not dead-lettered")
+	}
+}
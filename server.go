@@ -2,11 +2,14 @@ package wsqueue
 
 import (
 	"encoding/json"
+	"errors"
 	"expvar"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
@@ -30,12 +33,58 @@ var Warnfunc = log.Printf
 
 //Server is a server
 type Server struct {
-	Router          *mux.Router
-	RoutePrefix     string
-	QueuesCounter   *expvar.Int
-	TopicsCounter   *expvar.Int
-	ClientsCounter  *expvar.Int
-	MessagesCounter *expvar.Int
+	Router                     *mux.Router
+	RoutePrefix                string
+	QueuesCounter              *expvar.Int
+	TopicsCounter              *expvar.Int
+	ClientsCounter             *expvar.Int
+	MessagesCounter            *expvar.Int
+	RejectedConnectionsCounter *expvar.Int
+	RejectedMessagesCounter    *expvar.Int
+	OversizedMessagesCounter   *expvar.Int
+	IdleConnectionsCounter     *expvar.Int
+	SlowConsumersCounter       *expvar.Int
+
+	//AllowedOrigins is a list of origin patterns (ex: https://*.example.com) allowed to connect.
+	//If empty (and CheckOrigin is nil), every origin is allowed
+	AllowedOrigins []string
+	//CheckOrigin is a custom function to check the Origin header; it takes precedence over AllowedOrigins
+	CheckOrigin func(r *http.Request) bool
+	//TrustedProxies is a list of IPs or CIDRs of the reverse proxies allowed to set X-Forwarded-For.
+	//The IP of the clients, used by IP ACEs and by connection and message limits, is read
+	//from the header only for requests coming from these proxies
+	TrustedProxies []string
+	//Compression enables the negotiation of permessage-deflate with the clients
+	Compression *CompressionOptions
+	//Keyring holds the keys used to encrypt and sign messages, see Options.Encryption and Options.Signature
+	Keyring *Keyring
+	//MaxFrameSize is the max size of the frames read from the clients. Bigger frames close
+	//the connection with a 1009 close code. 0 means no limit
+	MaxFrameSize int64
+	//MaxMessageSize is the max size of the body of the messages sent and received. 0 means no limit
+	MaxMessageSize int
+	//PingInterval is the interval between two pings sent to the clients. 0 disables pings
+	PingInterval time.Duration
+	//PongTimeout is the delay after which a client which has sent neither a pong nor a
+	//message is evicted. Default is twice PingInterval
+	PongTimeout time.Duration
+	//SendBufferSize is the max number of frames waiting to be written on a connection. Default is DefaultSendBufferSize
+	SendBufferSize int
+	//WriteTimeout is the deadline of a frame write. Default is DefaultWriteTimeout
+	WriteTimeout time.Duration
+	//SlowConsumerPolicy applies when the send buffer of a connection is full. Default is SlowConsumerDisconnect
+	SlowConsumerPolicy SlowConsumerPolicy
+
+	routesMutex *sync.RWMutex
+	routes      map[string]http.HandlerFunc
+	codecs      []Codec
+}
+
+//ErrorResponse is the JSON body of HTTP errors returned by the server
+type ErrorResponse struct {
+	Code        int    `json:"code"`
+	Reason      string `json:"reason"`
+	Destination string `json:"destination,omitempty"`
 }
 
 //StorageDriver is in-memory Stack or Redis server
@@ -45,10 +94,66 @@ type StorageDriver interface {
 	Pop() interface{}
 }
 
-//Options is options on topic or queues
+//Options is options on topic or queues. Ordered enables FIFO delivery per partition
+//key on queues, see HeaderPartitionKey
 type Options struct {
-	ACL     ACL            `json:"acl,omitempty"`
-	Storage StorageOptions `json:"storage,omitempty"`
+	ACL            ACL                        `json:"acl,omitempty"`
+	Storage        StorageOptions             `json:"storage,omitempty"`
+	AllowedOrigins []string                   `json:"allowed_origins,omitempty"`
+	CheckOrigin    func(r *http.Request) bool `json:"-"`
+	Limits         LimitOptions               `json:"limits,omitempty"`
+	Ordered        bool                       `json:"ordered,omitempty"`
+	//ContentEncoding compresses the payload of messages bigger than ContentEncodingThreshold. See EncodingGzip and EncodingZstd
+	ContentEncoding          string `json:"content_encoding,omitempty"`
+	ContentEncodingThreshold int    `json:"content_encoding_threshold,omitempty"`
+	//Schemas validates the messages sent and received, according to their application-type
+	Schemas *SchemaRegistry `json:"-"`
+	//DeadLetter receives the invalid messages. If nil, invalid messages are rejected
+	DeadLetter *Queue `json:"-"`
+	//Encryption is the ID of the key of the server Keyring used to encrypt the payload of messages
+	Encryption string `json:"encryption,omitempty"`
+	//Signature is the ID of the key of the server Keyring used to sign messages
+	Signature string `json:"signature,omitempty"`
+	//DedupWindow drops silently the messages whose idempotency key has already been sent
+	//within the window, see HeaderDedupID. 0 disables deduplication
+	DedupWindow time.Duration `json:"dedup_window,omitempty"`
+	//DedupSize is the max number of idempotency keys kept in memory. Default is 10000
+	DedupSize int `json:"dedup_size,omitempty"`
+	//ChunkSize splits the frames bigger than ChunkSize bytes in several chunks. 0 disables chunking.
+	//The chunks are interleaved with the other frames of the connection, so a small message
+	//may be received before a large message sent earlier
+	ChunkSize int `json:"chunk_size,omitempty"`
+	//MaxFrameSize overrides Server.MaxFrameSize
+	MaxFrameSize int64 `json:"max_frame_size,omitempty"`
+	//MaxMessageSize overrides Server.MaxMessageSize
+	MaxMessageSize int `json:"max_message_size,omitempty"`
+}
+
+//prepare validates a message and applies the options to it before it is sent: the
+//payload is compressed, then encrypted, then the message is signed
+func (o *Options) prepare(m *Message, keys *Keyring) error {
+	if o == nil {
+		return nil
+	}
+	if err := o.validate(m); err != nil {
+		return err
+	}
+	if o.ContentEncoding != "" && len(m.Bytes()) >= o.ContentEncodingThreshold {
+		if err := m.compress(o.ContentEncoding); err != nil {
+			return err
+		}
+	}
+	if o.Encryption != "" {
+		if err := m.encrypt(keys, o.Encryption); err != nil {
+			return err
+		}
+	}
+	if o.Signature != "" {
+		if err := m.sign(keys, o.Signature); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 //StorageOptions is a collection of options, see storage documentation
@@ -59,21 +164,78 @@ type ConnID string
 
 //Conn is a conn
 type Conn struct {
-	ID     ConnID
-	WSConn *websocket.Conn
+	ID       ConnID
+	WSConn   *websocket.Conn
+	Identity *Identity
+	//Prefetch is the max number of unacknowledged messages a queue consumer accepts. 0 means no limit
+	Prefetch int
+	//Weight is the weight of a queue consumer for the Weighted LoadBalancer
+	Weight int
+	//BatchSize is the max number of messages sent to a queue consumer in a single frame
+	BatchSize int
+	//BatchDelay is the max delay before sending an incomplete batch to a queue consumer
+	BatchDelay  time.Duration
+	batch       []*Message
+	batchTimer  *time.Timer
+	inflight    int
+	codec       Codec
+	compression *CompressionOptions
+	chunkSize   int
+	request     *http.Request
+	//sendQueue holds the frames written by the writer goroutine of the connection
+	sendQueue     chan frame
+	closed        chan struct{}
+	done          chan struct{}
+	writeTimeout  time.Duration
+	policy        SlowConsumerPolicy
+	slowConsumers *expvar.Int
 }
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
+//Codec returns the codec negotiated with the client
+func (c *Conn) Codec() Codec {
+	if c.codec == nil {
+		return JSONCodec
+	}
+	return c.codec
 }
 
-//NewServer init a new WSQueue server
+//write encodes m with the codec of the connection and writes it
+func (c *Conn) write(m *Message) error {
+	b, err := c.Codec().Marshal(m)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(frameType(c.Codec()), b)
+}
+
+//writeFrame queues a frame encoded with the codec of the connection, in chunks if
+//it is bigger than the chunk size
+func (c *Conn) writeFrame(messageType int, b []byte) error {
+	frames, err := chunks(c.Codec(), b, c.chunkSize)
+	if err != nil {
+		return err
+	}
+	return c.enqueue(frame{messageType: messageType, data: frames[0], chunks: frames[1:]})
+}
+
+//InFlight returns the number of messages sent to a queue consumer and not yet acknowledged
+func (c *Conn) InFlight() int {
+	return c.inflight
+}
+
+//NewServer init a new WSQueue server. Topics and queues are routed dynamically
+//under routePrefix/wsqueue/, so they can be registered while the server is running
 func NewServer(router *mux.Router, routePrefix string) *Server {
 	s := &Server{
 		Router:      router,
 		RoutePrefix: routePrefix,
+		routesMutex: &sync.RWMutex{},
+		routes:      make(map[string]http.HandlerFunc),
+		codecs:      []Codec{JSONCodec, MessagePackCodec, CBORCodec},
 	}
+	s.Keyring, _ = NewKeyring()
 	router.HandleFunc(routePrefix+"/vars", varsHandler)
+	router.HandleFunc(routePrefix+"/wsqueue/{type:topic|queue}/{name:.+}", s.route)
 	if routePrefix != "" {
 		routePrefix = "." + routePrefix
 	}
@@ -81,43 +243,156 @@ func NewServer(router *mux.Router, routePrefix string) *Server {
 	s.TopicsCounter = expvar.NewInt("wsqueue" + routePrefix + ".stats.topics.counter")
 	s.ClientsCounter = expvar.NewInt("wsqueue" + routePrefix + ".stats.clients.counter")
 	s.MessagesCounter = expvar.NewInt("wsqueue" + routePrefix + ".stats.messages.counter")
+	s.RejectedConnectionsCounter = expvar.NewInt("wsqueue" + routePrefix + ".stats.rejected.connections.counter")
+	s.RejectedMessagesCounter = expvar.NewInt("wsqueue" + routePrefix + ".stats.rejected.messages.counter")
+	s.OversizedMessagesCounter = expvar.NewInt("wsqueue" + routePrefix + ".stats.oversized.messages.counter")
+	s.IdleConnectionsCounter = expvar.NewInt("wsqueue" + routePrefix + ".stats.idle.connections.counter")
+	s.SlowConsumersCounter = expvar.NewInt("wsqueue" + routePrefix + ".stats.slow.consumers.counter")
 
 	return s
 }
+
+//RegisterCodec adds a codec to the codecs supported by the server. JSON, MessagePack
+//and CBOR are supported by default. The codec replaces any codec with the same name
+func (s *Server) RegisterCodec(c Codec) {
+	s.routesMutex.Lock()
+	defer s.routesMutex.Unlock()
+	codecs := []Codec{}
+	for _, codec := range s.codecs {
+		if codec.Name() != c.Name() {
+			codecs = append(codecs, codec)
+		}
+	}
+	s.codecs = append(codecs, c)
+}
+
+func (s *Server) handle(t wsqueueType, name string, handler http.HandlerFunc) {
+	s.routesMutex.Lock()
+	s.routes[string(t)+"/"+name] = handler
+	s.routesMutex.Unlock()
+}
+
+func (s *Server) route(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	s.routesMutex.RLock()
+	handler, ok := s.routes[vars["type"]+"/"+vars["name"]]
+	s.routesMutex.RUnlock()
+	if !ok {
+		Warnfunc("Unknown %s %s", vars["type"], vars["name"])
+		writeError(w, http.StatusNotFound, fmt.Sprintf("Unknown %s", vars["type"]), vars["name"])
+		return
+	}
+	handler(w, r)
+}
+
+func writeError(w http.ResponseWriter, code int, reason string, destination string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(ErrorResponse{
+		Code:        code,
+		Reason:      reason,
+		Destination: destination,
+	})
+}
+
 func (s *Server) createHandler(
+	destination string,
 	mutex *sync.RWMutex,
 	wsConnections *map[ConnID]*Conn,
 	openedConnectionCallback *func(*Conn),
 	closedConnectionCallback *func(*Conn),
 	onMessageCallback *func(*Conn, *Message) error,
-	options *Options,
+	acked func(*Conn, []Message) bool,
+	options **Options,
 ) func(
 	w http.ResponseWriter,
 	r *http.Request,
 ) {
+	limiter := newLimiter()
 	return func(w http.ResponseWriter, r *http.Request) {
+		if ip := forwardedIP(r, s.TrustedProxies); ip != "" {
+			r.RemoteAddr = ip
+		}
+
+		mutex.RLock()
+		options := *options
+		mutex.RUnlock()
+
+		var limits LimitOptions
+		var chunkSize int
+		if options != nil {
+			limits = options.Limits
+			chunkSize = options.ChunkSize
+		}
+
+		s.routesMutex.RLock()
+		codecs := s.codecs
+		s.routesMutex.RUnlock()
+
+		upgrader := websocket.Upgrader{
+			CheckOrigin:       s.originChecker(options),
+			EnableCompression: s.Compression != nil,
+			Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+				writeError(w, status, reason.Error(), destination)
+			},
+		}
 
+		identity := &Identity{IP: remoteIP(r)}
 		if options != nil && len(options.ACL) > 0 {
-			if !checkACL(options.ACL, w, r) {
+			var ok bool
+			identity, ok = checkACL(options.ACL, destination, w, r, s.TrustedProxies)
+			if !ok {
 				Warnfunc("Not Authorized by ACL")
-				w.Write([]byte("Not Authorized by ACL"))
 				return
 			}
 		}
 
-		c, err := upgrader.Upgrade(w, r, nil)
+		if !limiter.acquire(identity.key(), limits.MaxConnections) {
+			Warnfunc("Too many connections for %s", identity.key())
+			s.RejectedConnectionsCounter.Add(1)
+			writeError(w, http.StatusTooManyRequests, "Too many connections", destination)
+			return
+		}
+		defer limiter.release(identity.key(), limits.MessageRate, limits.MessageBurst)
+
+		//The codec is the first one offered by the client which is supported by the server
+		var header http.Header
+		codec := negotiateCodec(codecs, websocket.Subprotocols(r))
+		if codec != nil {
+			header = http.Header{"Sec-Websocket-Protocol": {codec.Name()}}
+		} else {
+			codec = JSONCodec
+		}
+
+		//On failure, the upgrader replies with an HTTP error through upgrader.Error
+		c, err := upgrader.Upgrade(w, r, header)
 		if err != nil {
 			Warnfunc("Cannot upgrade connection %s", err.Error())
-			w.Write([]byte(fmt.Sprintf("Cannot upgrade connection %s", err.Error())))
-			w.WriteHeader(426)
 			return
 		}
 
 		mutex.Lock()
 		conn := &Conn{
-			ID:     ConnID(uuid.NewV4().String()),
-			WSConn: c,
+			ID:          ConnID(uuid.NewV4().String()),
+			WSConn:      c,
+			Identity:    identity,
+			codec:       codec,
+			compression: s.Compression,
+			chunkSize:   chunkSize,
+			request:     r,
+		}
+		if s.Compression != nil && s.Compression.Level != 0 {
+			c.SetCompressionLevel(s.Compression.Level)
+		}
+		if max := s.maxFrameSize(options); max > 0 {
+			c.SetReadLimit(max)
 		}
+		conn.startWriter(s.SendBufferSize, s.WriteTimeout, s.SlowConsumerPolicy, s.SlowConsumersCounter)
+		conn.Prefetch, _ = strconv.Atoi(r.URL.Query().Get("prefetch"))
+		conn.Weight, _ = strconv.Atoi(r.URL.Query().Get("weight"))
+		conn.BatchSize, _ = strconv.Atoi(r.URL.Query().Get("batch"))
+		delay, _ := strconv.Atoi(r.URL.Query().Get("batch_delay"))
+		conn.BatchDelay = time.Duration(delay) * time.Millisecond
 		if (*wsConnections)[conn.ID] != nil {
 			(*wsConnections)[conn.ID].WSConn.Close()
 			(*closedConnectionCallback)((*wsConnections)[conn.ID])
@@ -132,9 +407,20 @@ func (s *Server) createHandler(
 		s.ClientsCounter.Add(1)
 
 		defer c.Close()
+		defer conn.stopWriter()
+		keepalive := startHeartbeat(c, s.PingInterval, s.PongTimeout)
+		defer keepalive.Stop()
 		for {
 			_, message, err := c.ReadMessage()
 			if err != nil {
+				if errors.Is(err, websocket.ErrReadLimit) {
+					Warnfunc("Frame from %s too large. Closing connection", conn.ID)
+					s.oversized()
+				}
+				if isTimeout(err) {
+					Warnfunc("Connection %s is idle. Evicting", conn.ID)
+					s.IdleConnectionsCounter.Add(1)
+				}
 				mutex.Lock()
 				delete(*wsConnections, conn.ID)
 				mutex.Unlock()
@@ -144,13 +430,58 @@ func (s *Server) createHandler(
 				s.ClientsCounter.Add(-1)
 				break
 			}
+			keepalive.alive()
+
+			var parsedMessage Message
+			if e := conn.Codec().Unmarshal(message, &parsedMessage); e != nil {
+				Warnfunc("Cannot Unmarshall message : %s", e.Error())
+				continue
+			}
+			messages := []Message{parsedMessage}
+			if parsedMessage.IsBatch() {
+				messages = parsedMessage.Batch
+			}
+
+			//Acks of messages in flight are not limited: a dropped ack would never give back its credit to the consumer
+			if !(acked != nil && acked(conn, messages)) && !limiter.allowN(identity.key(), limits.MessageRate, limits.MessageBurst, len(messages)) {
+				Warnfunc("Too many messages from %s. Message dropped", identity.key())
+				s.RejectedMessagesCounter.Add(int64(len(messages)))
+				continue
+			}
 
 			if (*onMessageCallback) != nil {
-				var parsedMessage Message
-				if e := json.Unmarshal(message, &parsedMessage); err != nil {
-					Warnfunc("Cannot Unmarshall message", e.Error())
+				for i := range messages {
+					m := &messages[i]
+					//Only the destinations tracking acks handle them
+					if acked == nil && m.isAck() {
+						continue
+					}
+					max := s.maxMessageSize(options)
+					e := m.open(s.Keyring, false, max)
+					if e == nil && max > 0 && len(m.Bytes()) > max {
+						e = fmt.Errorf("%w : %d bytes", ErrMessageTooLarge, len(m.Bytes()))
+					}
+					if errors.Is(e, ErrMessageTooLarge) {
+						Warnfunc("Message %s from %s too large : %s", m.ID(), conn.ID, e.Error())
+						s.oversized()
+						reason := fmt.Sprintf("Message too large, max is %d bytes", max)
+						if e, err := newErrorMessage(http.StatusRequestEntityTooLarge, reason, destination, m.ID()); err == nil {
+							conn.write(e)
+						}
+						continue
+					}
+					if e != nil {
+						Warnfunc("Cannot open message : %s", e.Error())
+						continue
+					}
+					if e := options.validate(m); e != nil {
+						Warnfunc("Message from %s rejected : %s", conn.ID, e.Error())
+						s.RejectedMessagesCounter.Add(1)
+						options.deadLetter(destination, m, e)
+						continue
+					}
+					(*onMessageCallback)(conn, m)
 				}
-				(*onMessageCallback)(conn, &parsedMessage)
 			}
 		}
 
@@ -6,63 +6,85 @@ import (
 	"time"
 )
 
-//Stack is a thread-safe "First In First Out" stack
+//Stack is a thread-safe in-memory storage. It is a "First In First Out" queue by default,
+//or a "Last In First Out" stack with the storage option "order" set to "lifo".
+//Items are kept in a ring buffer so that Push, Pop, Peek and Get cost O(1)
 type Stack struct {
-	top   *stackItem
+	items []interface{}
+	head  int
 	count int
 	mutex *sync.Mutex
 	max   int
+	lifo  bool
 }
 
-type stackItem struct {
-	data interface{}
-	next *stackItem
-}
+const (
+	//StackFIFO is the "order" storage option of a "First In First Out" Stack
+	StackFIFO = "fifo"
+	//StackLIFO is the "order" storage option of a "Last In First Out" Stack
+	StackLIFO = "lifo"
+)
 
-//NewStack intialize a brand new Stack
+//NewStack intialize a brand new FIFO Stack
 func NewStack() *Stack {
 	s := &Stack{}
 	s.mutex = &sync.Mutex{}
 	return s
 }
 
-//Open the connection to the storage driver
+//Open the connection to the storage driver. Options are "capacity" (int) and "order" (fifo or lifo)
 func (s *Stack) Open(o *Options) {
-	if o != nil {
-		m := o.Storage
-		i, b := m["capacity"].(int)
+	if o == nil {
+		return
+	}
+	m := o.Storage
+	if c, ok := m["capacity"]; ok {
+		i, b := c.(int)
 		if !b {
-			Logfunc("Error with stack capacity option : %s", i)
-			return
+			Logfunc("Error with stack capacity option : %v", c)
+		} else {
+			s.max = i
+		}
+	}
+	if order, ok := m["order"]; ok {
+		switch order {
+		case StackFIFO:
+			s.lifo = false
+		case StackLIFO:
+			s.lifo = true
+		default:
+			Logfunc("Error with stack order option : %v", order)
 		}
-		s.max = i
 	}
 }
 
-// Get peeks at the n-th item in the stack. Unlike other operations, this one costs O(n).
-func (s *Stack) Get(index int) (interface{}, error) {
-	if index < 0 || index >= s.count {
-		return nil, fmt.Errorf("Requested index %d outside stack, length %d", index, s.count)
+//index returns the position in the ring buffer of the n-th item to be popped. The mutex must be held
+func (s *Stack) index(n int) int {
+	if s.lifo {
+		return (s.head + s.count - 1 - n) % len(s.items)
 	}
+	return (s.head + n) % len(s.items)
+}
 
+// Get peeks at the n-th item to be popped: 0 is the item returned by Peek and Pop.
+func (s *Stack) Get(index int) (interface{}, error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	n := s.top
-	for i := 1; i < s.count-index; i++ {
-		n = n.next
+	if index < 0 || index >= s.count {
+		return nil, fmt.Errorf("Requested index %d outside stack, length %d", index, s.count)
 	}
-
-	return n.data, nil
+	return s.items[s.index(index)], nil
 }
 
-// Dump prints of the stack.
+// Dump prints of the stack, in the order items will be popped.
 func (s *Stack) Dump() {
-	n := s.top
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
 	fmt.Print("[ ")
 	for i := 0; i < s.count; i++ {
-		fmt.Printf("%+v ", n.data)
-		n = n.next
+		fmt.Printf("%+v ", s.items[s.index(i)])
 	}
 	fmt.Print("]")
 }
@@ -74,7 +96,7 @@ func (s *Stack) Len() int {
 	return s.count
 }
 
-//Push add an item a the top of the stack
+//Push add an item at the tail of the stack. If the stack is full, it waits for an item to be popped
 func (s *Stack) Push(item interface{}) {
 	if s.max > 0 {
 		f := NewFibonacci()
@@ -84,49 +106,55 @@ func (s *Stack) Push(item interface{}) {
 		}
 	}
 
-	n := &stackItem{data: item}
-
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	if s.top == nil {
-		s.top = n
-	} else {
-		n.next = s.top
-		s.top = n
+	if s.count == len(s.items) {
+		s.grow()
 	}
-
+	s.items[(s.head+s.count)%len(s.items)] = item
 	s.count++
 }
 
-//Pop returns and removes the botteom of the stack
+//grow doubles the size of the ring buffer. The mutex must be held
+func (s *Stack) grow() {
+	size := 2 * len(s.items)
+	if size == 0 {
+		size = 16
+	}
+	items := make([]interface{}, size)
+	for i := 0; i < s.count; i++ {
+		items[i] = s.items[(s.head+i)%len(s.items)]
+	}
+	s.items = items
+	s.head = 0
+}
+
+//Pop returns and removes the head of the stack (the oldest item), or its tail (the newest item) in LIFO order
 func (s *Stack) Pop() interface{} {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	var n *stackItem
-	if s.top != nil {
-		n = s.top
-		s.top = n.next
-		s.count--
-	}
-
-	if n == nil {
+	if s.count == 0 {
 		return nil
 	}
 
-	return n.data
-
+	i := s.index(0)
+	data := s.items[i]
+	s.items[i] = nil
+	if !s.lifo {
+		s.head = (s.head + 1) % len(s.items)
+	}
+	s.count--
+	return data
 }
 
-//Peek returns but doesn't remove the top of the stack
+//Peek returns but doesn't remove the item which will be returned by Pop
 func (s *Stack) Peek() interface{} {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	n := s.top
-	if n == nil || n.data == nil {
+	if s.count == 0 {
 		return nil
 	}
-
-	return n.data
+	return s.items[s.index(0)]
 }
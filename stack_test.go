@@ -1 +1,81 @@
 package wsqueue
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStackShouldBeFIFOByDefault(t *testing.T) {
+	s := NewStack()
+	s.Open(&Options{Storage: StorageOptions{"capacity": 10}})
+	assert.Nil(t, s.Pop())
+	assert.Nil(t, s.Peek())
+
+	s.Push(1)
+	s.Push(2)
+	s.Push(3)
+	assert.Equal(t, 3, s.Len())
+	assert.Equal(t, 1, s.Peek())
+
+	for i := 0; i < 3; i++ {
+		d, err := s.Get(i)
+		assert.NoError(t, err)
+		assert.Equal(t, i+1, d)
+	}
+	_, err := s.Get(3)
+	assert.Error(t, err)
+
+	assert.Equal(t, 1, s.Pop())
+	assert.Equal(t, 2, s.Pop())
+	assert.Equal(t, 3, s.Pop())
+	assert.Nil(t, s.Pop())
+	assert.Equal(t, 0, s.Len())
+}
+
+func TestStackShouldBeLIFOWithOrderOption(t *testing.T) {
+	s := NewStack()
+	s.Open(&Options{Storage: StorageOptions{"order": StackLIFO}})
+
+	s.Push(1)
+	s.Push(2)
+	s.Push(3)
+	assert.Equal(t, 3, s.Peek())
+
+	for i := 0; i < 3; i++ {
+		d, err := s.Get(i)
+		assert.NoError(t, err)
+		assert.Equal(t, 3-i, d)
+	}
+
+	assert.Equal(t, 3, s.Pop())
+	s.Push(4)
+	assert.Equal(t, 4, s.Pop())
+	assert.Equal(t, 2, s.Pop())
+	assert.Equal(t, 1, s.Pop())
+	assert.Nil(t, s.Pop())
+}
+
+func TestStackShouldKeepOrderWhenGrowing(t *testing.T) {
+	s := NewStack()
+	for i := 0; i < 10; i++ {
+		s.Push(i)
+	}
+	//Move the head so that items wrap around the ring buffer
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, i, s.Pop())
+	}
+	for i := 10; i < 100; i++ {
+		s.Push(i)
+	}
+	assert.Equal(t, 95, s.Len())
+	for i := 5; i < 100; i++ {
+		d, err := s.Get(i - 5)
+		assert.NoError(t, err)
+		assert.Equal(t, i, d)
+	}
+	for i := 5; i < 100; i++ {
+		assert.Equal(t, i, s.Pop())
+	}
+	assert.Nil(t, s.Pop())
+}
@@ -1,7 +1,6 @@
 package wsqueue
 
 import (
-	"encoding/json"
 	"log"
 	"sync"
 )
@@ -19,6 +18,8 @@ type Topic struct {
 	OnMessageHandler        func(*Conn, *Message) error `json:"-"`
 	mutex                   *sync.RWMutex
 	wsConnections           map[ConnID]*Conn
+	server                  *Server
+	dedup                   *dedupCache
 }
 
 //CreateTopic create topic
@@ -33,6 +34,7 @@ func (s *Server) newTopic(topic string) (*Topic, error) {
 		Topic:         topic,
 		mutex:         &sync.RWMutex{},
 		wsConnections: make(map[ConnID]*Conn),
+		dedup:         newDedupCache(),
 	}
 	return t, nil
 }
@@ -41,25 +43,62 @@ func (s *Server) newTopic(topic string) (*Topic, error) {
 func (s *Server) RegisterTopic(t *Topic) {
 	log.Printf("Register queue %s on route %s", t.Topic, s.RoutePrefix+"/wsqueue/topic/"+t.Topic)
 	handler := s.createHandler(
+		t.Topic,
 		t.mutex,
 		&t.wsConnections,
 		&t.OpenedConnectionHandler,
 		&t.ClosedConnectionHandler,
 		&t.OnMessageHandler,
-		t.Options,
+		nil,
+		&t.Options,
 	)
-	s.Router.HandleFunc(s.RoutePrefix+"/wsqueue/topic/"+t.Topic, handler)
+	t.server = s
+	s.handle(topic, t.Topic, handler)
 	s.TopicsCounter.Add(1)
 
 }
 
 func (t *Topic) publish(m Message) error {
-	t.mutex.Lock()
-	b, _ := json.Marshal(m)
+	return t.publishBatch([]*Message{&m})
+}
+
+//publishBatch applies the options of the topic to new messages and sends them in a single frame
+func (t *Topic) publishBatch(ms []*Message) error {
+	t.mutex.RLock()
+	options := t.Options
+	t.mutex.RUnlock()
+	ms, err := options.accept(t.server, t.Topic, ms, t.dedup, nil)
+	if err != nil || len(ms) == 0 {
+		return err
+	}
+	frame := ms[0]
+	if len(ms) > 1 {
+		frame = newBatchMessage(ms)
+	}
+
+	//Frames are queued without the lock, so that a slow subscriber does not block the topic
+	t.mutex.RLock()
+	conns := make([]*Conn, 0, len(t.wsConnections))
 	for _, conn := range t.wsConnections {
-		conn.WSConn.WriteMessage(1, b)
+		conns = append(conns, conn)
+	}
+	t.mutex.RUnlock()
+
+	//Messages are encoded once per codec
+	frames := make(map[string][]byte)
+	for _, conn := range conns {
+		codec := conn.Codec()
+		b, ok := frames[codec.Name()]
+		if !ok {
+			var err error
+			b, err = codec.Marshal(frame)
+			if err != nil {
+				return err
+			}
+			frames[codec.Name()] = b
+		}
+		conn.writeFrame(frameType(codec), b)
 	}
-	t.mutex.Unlock()
 	return nil
 }
 
@@ -71,3 +110,34 @@ func (t *Topic) Publish(data interface{}) error {
 	}
 	return t.publish(*m)
 }
+
+//PublishWithHeaders send message to everyone, with user headers
+func (t *Topic) PublishWithHeaders(data interface{}, h Header) error {
+	m, e := newMessage(data)
+	if e != nil {
+		return e
+	}
+	if m, e = m.withHeaders(h); e != nil {
+		return e
+	}
+	return t.publish(*m)
+}
+
+//PublishMessage send a message built with NewMessage to everyone
+func (t *Topic) PublishMessage(m *Message) error {
+	if e := m.check(); e != nil {
+		return e
+	}
+	return t.publish(*m)
+}
+
+//SetACL replaces atomically the ACL of the topic. If disconnect is true, connections
+//which are not authorized anymore by the new ACL are closed
+func (t *Topic) SetACL(acl ACL, disconnect bool) {
+	setACL(t.mutex, &t.Options, t.wsConnections, acl, disconnect, t.server.trustedProxies())
+}
+
+//PublishBinary send a binary message to everyone, with a MIME content-type
+func (t *Topic) PublishBinary(contentType string, data []byte) error {
+	return t.publish(*newBinaryMessage(contentType, data))
+}
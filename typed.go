@@ -0,0 +1,26 @@
+package wsqueue
+
+import "reflect"
+
+//Publish sends a typed message to everyone subscribed to the topic
+func Publish[T any](t *Topic, data T) error {
+	return t.Publish(data)
+}
+
+//Send sends a typed message to the queue
+func Send[T any](q *Queue, data T) error {
+	return q.Send(data)
+}
+
+//Decode decodes the body of a message in a T. It checks that the message has
+//been sent with the same type, according to its application-type. T may be a pointer
+func Decode[T any](m Message) (T, error) {
+	var data T
+	v := reflect.ValueOf(&data).Elem()
+	if v.Kind() == reflect.Ptr {
+		v.Set(reflect.New(v.Type().Elem()))
+		v = v.Elem()
+	}
+	err := m.decode(v)
+	return data, err
+}
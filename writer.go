@@ -0,0 +1,178 @@
+package wsqueue
+
+import (
+	"errors"
+	"expvar"
+	"time"
+)
+
+//SlowConsumerPolicy is the behaviour of the server when the send queue of a connection is full
+type SlowConsumerPolicy string
+
+const (
+	//SlowConsumerDisconnect closes the connections which cannot keep up. This is the default policy
+	SlowConsumerDisconnect SlowConsumerPolicy = "disconnect"
+	//SlowConsumerDrop drops the messages sent to a full connection. Queue messages are requeued
+	SlowConsumerDrop SlowConsumerPolicy = "drop"
+	//SlowConsumerBlock waits for the send queue to have room. One slow consumer slows down the
+	//producers, until one of its writes times out and the connection is closed
+	SlowConsumerBlock SlowConsumerPolicy = "block"
+)
+
+const (
+	//DefaultSendBufferSize is the default number of frames waiting to be written on a connection
+	DefaultSendBufferSize = 256
+	//DefaultWriteTimeout is the default deadline of a frame write
+	DefaultWriteTimeout = 10 * time.Second
+)
+
+var (
+	//ErrSlowConsumer is returned when a frame cannot be queued on a full connection
+	ErrSlowConsumer = errors.New("Slow consumer")
+	//errConnClosed is returned when a frame is queued on a closed connection
+	errConnClosed = errors.New("Connection closed")
+)
+
+//frame is a frame waiting to be written on a connection. The chunks of a large message
+//are queued in a single frame and written in turn with the other frames
+type frame struct {
+	messageType int
+	data        []byte
+	chunks      [][]byte
+}
+
+//next returns the frame holding the chunks left to write after f
+func (f frame) next() (frame, bool) {
+	if len(f.chunks) == 0 {
+		return frame{}, false
+	}
+	return frame{messageType: f.messageType, data: f.chunks[0], chunks: f.chunks[1:]}, true
+}
+
+//startWriter starts the writer goroutine of the connection. It stops when closed is
+//closed or when a write fails, and then closes done
+func (c *Conn) startWriter(size int, timeout time.Duration, policy SlowConsumerPolicy, counter *expvar.Int) {
+	if size <= 0 {
+		size = DefaultSendBufferSize
+	}
+	if timeout <= 0 {
+		timeout = DefaultWriteTimeout
+	}
+	if policy == "" {
+		policy = SlowConsumerDisconnect
+	}
+	c.sendQueue = make(chan frame, size)
+	c.closed = make(chan struct{})
+	c.done = make(chan struct{})
+	c.writeTimeout = timeout
+	c.policy = policy
+	c.slowConsumers = counter
+	go func() {
+		defer close(c.done)
+		//pending holds the frames to write in turn: a chunked message goes back to the end
+		//of pending after each chunk, so that it does not stall the other frames
+		var pending []frame
+		for {
+			f, ok := c.nextFrame(&pending, size)
+			if !ok {
+				return
+			}
+			if err := c.writeNow(f); err != nil {
+				Warnfunc("Cannot write to %s : %s. Closing connection", c.ID, err.Error())
+				c.WSConn.Close()
+				return
+			}
+			if next, ok := f.next(); ok {
+				pending = append(pending, next)
+			}
+		}
+	}()
+}
+
+//nextFrame returns the next frame to write. A queued frame is moved to pending if
+//pending has less than size frames, then the head of pending is returned. It returns
+//false when the writer is stopped
+func (c *Conn) nextFrame(pending *[]frame, size int) (frame, bool) {
+	if len(*pending) < size {
+		select {
+		case f := <-c.sendQueue:
+			*pending = append(*pending, f)
+		case <-c.closed:
+			return frame{}, false
+		default:
+		}
+	}
+	if len(*pending) == 0 {
+		select {
+		case f := <-c.sendQueue:
+			*pending = append(*pending, f)
+		case <-c.closed:
+			return frame{}, false
+		}
+	}
+	f := (*pending)[0]
+	*pending = (*pending)[1:]
+	return f, true
+}
+
+//stopWriter stops the writer goroutine. The frames still queued are dropped
+func (c *Conn) stopWriter() {
+	if c.closed != nil {
+		close(c.closed)
+	}
+}
+
+//writeNow writes a frame on the websocket, compressed if it reaches the compression threshold
+func (c *Conn) writeNow(f frame) error {
+	if c.compression != nil {
+		c.WSConn.EnableWriteCompression(len(f.data) >= c.compression.Threshold)
+	}
+	if c.writeTimeout > 0 {
+		c.WSConn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	return c.WSConn.WriteMessage(f.messageType, f.data)
+}
+
+//enqueue hands a frame to the writer goroutine, according to the slow consumer policy
+//if the send queue is full. Without writer goroutine, the frame is written synchronously.
+//With SlowConsumerBlock, it waits until the send queue has room or the writer goroutine exits
+func (c *Conn) enqueue(f frame) error {
+	if c.sendQueue == nil {
+		for ok := true; ok; f, ok = f.next() {
+			if err := c.writeNow(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	select {
+	case c.sendQueue <- f:
+		return nil
+	case <-c.closed:
+		return errConnClosed
+	case <-c.done:
+		return errConnClosed
+	default:
+	}
+
+	if c.policy == SlowConsumerBlock {
+		select {
+		case c.sendQueue <- f:
+			return nil
+		case <-c.closed:
+			return errConnClosed
+		case <-c.done:
+			return errConnClosed
+		}
+	}
+	if c.slowConsumers != nil {
+		c.slowConsumers.Add(1)
+	}
+	if c.policy == SlowConsumerDisconnect {
+		Warnfunc("Send queue of %s is full. Closing connection", c.ID)
+		c.WSConn.Close()
+	} else {
+		Warnfunc("Send queue of %s is full. Dropping frame", c.ID)
+	}
+	return ErrSlowConsumer
+}
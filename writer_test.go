@@ -0,0 +1,104 @@
+package wsqueue
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlowConsumerPolicies(t *testing.T) {
+	counter := new(expvar.Int)
+	c := &Conn{
+		ID:            "slow",
+		sendQueue:     make(chan frame, 1),
+		closed:        make(chan struct{}),
+		policy:        SlowConsumerDrop,
+		slowConsumers: counter,
+	}
+	assert.NoError(t, c.enqueue(frame{data: []byte("foo")}))
+	assert.True(t, errors.Is(c.enqueue(frame{data: []byte("bar")}), ErrSlowConsumer))
+	assert.Equal(t, int64(1), counter.Value())
+
+	c.policy = SlowConsumerBlock
+	done := make(chan error)
+	go func() { done <- c.enqueue(frame{data: []byte("bar")}) }()
+	select {
+	case err := <-done:
+		t.Fatalf("Enqueue should block, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(t, "foo", string((<-c.sendQueue).data))
+	assert.NoError(t, <-done)
+
+	go func() { done <- c.enqueue(frame{data: []byte("baz")}) }()
+	c.stopWriter()
+	assert.Error(t, <-done)
+}
+
+func TestSlowSubscriberShouldNotBlockPublishing(t *testing.T) {
+	s, c, closeFunc := newTestServer(t, "/TestSlowConsumer")
+	defer closeFunc()
+	s.SendBufferSize = 4
+	topic := s.CreateTopic("topic")
+
+	sub, err := c.SubscribeContext(context.Background(), "topic")
+	assert.NoError(t, err)
+	//The slow subscriber never reads
+	slow, _, err := websocket.DefaultDialer.Dial("ws://"+c.Host+c.Route+"wsqueue/topic/topic", nil)
+	assert.NoError(t, err)
+	defer slow.Close()
+	waitForConnections(t, topic, 2)
+
+	slowConsumers := s.SlowConsumersCounter.Value()
+	body := strings.Repeat("a", 256*1024)
+	//Messages are published as soon as the fast subscriber receives the previous one
+	for i := 0; i < 128; i++ {
+		start := time.Now()
+		assert.NoError(t, topic.Publish(body))
+		assert.True(t, time.Since(start) < time.Second)
+		select {
+		case m := <-sub.Messages:
+			assert.Equal(t, len(body), len(m.Text()))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Message %d not received", i)
+		}
+	}
+	waitForConnections(t, topic, 1)
+	assert.Equal(t, slowConsumers+1, s.SlowConsumersCounter.Value())
+}
+
+func TestBlockPolicyShouldNotDeadlockOnWriteTimeout(t *testing.T) {
+	s, c, closeFunc := newTestServer(t, "/TestBlockPolicy")
+	defer closeFunc()
+	s.SendBufferSize = 1
+	s.WriteTimeout = 100 * time.Millisecond
+	s.SlowConsumerPolicy = SlowConsumerBlock
+	topic := s.CreateTopic("topic")
+
+	//The slow subscriber never reads
+	slow, _, err := websocket.DefaultDialer.Dial("ws://"+c.Host+c.Route+"wsqueue/topic/topic", nil)
+	assert.NoError(t, err)
+	defer slow.Close()
+	waitForConnections(t, topic, 1)
+
+	done := make(chan bool)
+	go func() {
+		body := strings.Repeat("a", 1<<20)
+		for i := 0; i < 64; i++ {
+			topic.Publish(body)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Publish is blocked")
+	}
+	waitForConnections(t, topic, 0)
+}